@@ -0,0 +1,43 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+func init() {
+	CapRegister(&Capability{name: "batch"})
+	TagCaps["batch"] = "batch"
+}
+
+// Start IRCv3 batch of specified type for the client. Returns batch
+// reference tag, that is empty if client has not enabled batch capability.
+func (c *Client) BatchStart(kind string, params ...string) string {
+	if !c.CapEnabled("batch") {
+		return ""
+	}
+	ref := NewMsgID()
+	c.Msg(NewMessage(*hostname, "BATCH", append([]string{"+" + ref, kind}, params...)...).String())
+	return ref
+}
+
+// Finish previously started batch.
+func (c *Client) BatchEnd(ref string) {
+	if ref == "" {
+		return
+	}
+	c.Msg(NewMessage(*hostname, "BATCH", "-"+ref).String())
+}
@@ -0,0 +1,182 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Maximal length of capabilities list in single CAP reply
+	CapLineLen = 400
+)
+
+// IRCv3 capability that can be negotiated by the client
+type Capability struct {
+	name string
+	// Optional value advertised to CAP LS 302 clients
+	value func() string
+	// Optional predicate telling if capability is offered at the moment
+	available func() bool
+}
+
+var (
+	capabilities  map[string]*Capability = make(map[string]*Capability)
+	capabilitiesM sync.RWMutex
+)
+
+// Register capability to be offered to clients. Features implementing
+// capabilities register them during initialization.
+func CapRegister(capability *Capability) {
+	capabilitiesM.Lock()
+	capabilities[capability.name] = capability
+	capabilitiesM.Unlock()
+}
+
+// Find capability currently offered to clients.
+func CapFind(name string) *Capability {
+	capabilitiesM.RLock()
+	capability, found := capabilities[name]
+	capabilitiesM.RUnlock()
+	if !found || (capability.available != nil && !capability.available()) {
+		return nil
+	}
+	return capability
+}
+
+// Sorted list of currently offered capabilities. Values are included
+// for CAP LS 302 capable clients.
+func CapList(withValues bool) []string {
+	capabilitiesM.RLock()
+	names := make([]string, 0, len(capabilities))
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	capabilitiesM.RUnlock()
+	sort.Strings(names)
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		capability := CapFind(name)
+		if capability == nil {
+			continue
+		}
+		if withValues && capability.value != nil {
+			if value := capability.value(); value != "" {
+				name = name + "=" + value
+			}
+		}
+		list = append(list, name)
+	}
+	return list
+}
+
+// Has client enabled the capability
+func (c *Client) CapEnabled(name string) bool {
+	c.Lock()
+	_, enabled := c.caps[name]
+	c.Unlock()
+	return enabled
+}
+
+// Send capabilities list splitting it on several CAP replies if needed.
+// Only CAP LS 302 capable clients understand multiline replies.
+func (c *Client) ReplyCapList(subcmd string, list []string) {
+	lines := make([]string, 0, 1)
+	line := ""
+	for _, name := range list {
+		if line != "" && len(line)+len(name) >= CapLineLen && c.capVersion >= 302 {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += name
+	}
+	lines = append(lines, line)
+	for n, line := range lines {
+		if n < len(lines)-1 {
+			c.Reply("CAP " + *c.nickname + " " + subcmd + " * :" + line)
+		} else {
+			c.Reply("CAP " + *c.nickname + " " + subcmd + " :" + line)
+		}
+	}
+}
+
+// CAP command processor. Capabilities negotiation started by
+// unregistered client suspends its registration until CAP END.
+func HandlerCap(client *Client, msg *Message) {
+	if msg.Param(0) == "" {
+		client.ReplyNotEnoughParameters("CAP")
+		return
+	}
+	subcmd := strings.ToUpper(msg.params[0])
+	arg := msg.Param(1)
+	switch subcmd {
+	case "LS":
+		if !client.registered {
+			client.negotiating = true
+		}
+		if version, err := strconv.Atoi(arg); err == nil && version > client.capVersion {
+			client.capVersion = version
+		}
+		client.ReplyCapList("LS", CapList(client.capVersion >= 302))
+	case "LIST":
+		list := make([]string, 0)
+		client.Lock()
+		for name := range client.caps {
+			list = append(list, name)
+		}
+		client.Unlock()
+		sort.Strings(list)
+		client.ReplyCapList("LIST", list)
+	case "REQ":
+		if !client.registered {
+			client.negotiating = true
+		}
+		requested := strings.Fields(arg)
+		if len(requested) == 0 {
+			client.ReplyNotEnoughParameters("CAP")
+			return
+		}
+		for _, name := range requested {
+			if CapFind(strings.TrimPrefix(name, "-")) == nil {
+				client.Reply("CAP " + *client.nickname + " NAK :" + arg)
+				return
+			}
+		}
+		client.Lock()
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(client.caps, name[1:])
+			} else {
+				client.caps[name] = struct{}{}
+			}
+		}
+		client.Unlock()
+		client.Reply("CAP " + *client.nickname + " ACK :" + arg)
+	case "END":
+		client.negotiating = false
+	default:
+		client.ReplyNicknamed("410", msg.params[0], "Invalid CAP command")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	CapRegister(&Capability{name: "test-cap"})
+	CapRegister(&Capability{name: "test-value", value: func() string { return "foo,bar" }})
+	CapRegister(&Capability{name: "test-unavailable", available: func() bool { return false }})
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+
+	conn.inbound <- "CAP LS"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost CAP * LS :") ||
+		!strings.Contains(r, " test-value") || strings.Contains(r, "test-unavailable") {
+		t.Fatal("CAP LS", r)
+	}
+	conn.inbound <- "CAP LS 302"
+	if r := <-conn.outbound; !strings.Contains(r, "test-value=foo,bar") {
+		t.Fatal("CAP LS 302", r)
+	}
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn.inbound <- "CAP REQ :test-cap test-unavailable"
+	if r := <-conn.outbound; r != ":foohost CAP nick1 NAK :test-cap test-unavailable\r\n" {
+		t.Fatal("CAP NAK", r)
+	}
+	if client.registered {
+		t.Fatal("registration is not suspended")
+	}
+	conn.inbound <- "CAP REQ :test-cap test-value"
+	if r := <-conn.outbound; r != ":foohost CAP nick1 ACK :test-cap test-value\r\n" {
+		t.Fatal("CAP ACK", r)
+	}
+	conn.inbound <- "CAP REQ -test-value"
+	if r := <-conn.outbound; r != ":foohost CAP nick1 ACK :-test-value\r\n" {
+		t.Fatal("CAP ACK removal", r)
+	}
+	conn.inbound <- "CAP LIST"
+	if r := <-conn.outbound; r != ":foohost CAP nick1 LIST :test-cap\r\n" {
+		t.Fatal("CAP LIST", r)
+	}
+	if !client.CapEnabled("test-cap") || client.CapEnabled("test-value") {
+		t.Fatal("enabled capabilities", client.caps)
+	}
+	conn.inbound <- "CAP FOO"
+	if r := <-conn.outbound; r != ":foohost 410 nick1 FOO :Invalid CAP command\r\n" {
+		t.Fatal("invalid CAP command", r)
+	}
+	conn.inbound <- "CAP END"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 001 nick1") {
+		t.Fatal("registration after CAP END", r)
+	}
+}
+
+func TestNotifyCaps(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "CAP LS 302"
+	<-conn1.outbound
+	conn1.inbound <- "CAP REQ :account-notify away-notify chghost extended-join"
+	<-conn1.outbound
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	if r := <-conn1.outbound; r != ":foohost 331 nick1 #foo :No topic is set\r\n" {
+		t.Fatal("topic", r)
+	}
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient JOIN #foo * :Long name1\r\n" {
+		t.Fatal("extended JOIN", r)
+	}
+	<-conn1.outbound
+	<-conn1.outbound
+	conn2.inbound <- "AWAY :gone"
+	if r := <-conn2.outbound; r != ":foohost 306 nick2 :You have been marked as being away\r\n" {
+		t.Fatal("AWAY", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient JOIN #foo * :Long name2\r\n" {
+		t.Fatal("extended JOIN of peer", r)
+	}
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient AWAY :gone\r\n" {
+		t.Fatal("AWAY of joined peer", r)
+	}
+	conn2.inbound <- "AWAY"
+	<-conn2.outbound
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient AWAY\r\n" {
+		t.Fatal("AWAY removal notify", r)
+	}
+	client2.SASLLoggedIn("account2")
+	<-conn2.outbound
+	<-conn2.outbound
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient ACCOUNT account2\r\n" {
+		t.Fatal("ACCOUNT notify", r)
+	}
+	HostChange(client2, "cloak.example")
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient CHGHOST foo2 cloak.example\r\n" {
+		t.Fatal("CHGHOST notify", r)
+	}
+	conn1.inbound <- "PRIVMSG #foo :hi"
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient PRIVMSG #foo :hi\r\n" {
+		t.Fatal("no CHGHOST without capability", r)
+	}
+	if client2.String() != "nick2!foo2@cloak.example" {
+		t.Fatal("changed host", client2)
+	}
+}
@@ -20,6 +20,10 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"log"
 	"net"
 	"strings"
@@ -30,6 +34,11 @@ import (
 const (
 	BufSize   = 1500
 	MaxOutBuf = 1 << 12
+	// Maximal length of IRCv3 message tags section, including leading
+	// "@" and trailing space
+	MaxTagsLen = 8191
+	// Maximal duration of client's address reverse resolving
+	HostResolveTimeout = 5 * time.Second
 )
 
 var (
@@ -42,8 +51,23 @@ type Client struct {
 	nickname      *string
 	username      *string
 	realname      *string
+	host          string
 	password      *string
 	away          *string
+	invisible     bool
+	account       *string
+	saslMechanism string
+	saslBuf       string
+	certfp        string
+	caps          map[string]struct{}
+	capVersion    int
+	negotiating   bool
+	label         *string
+	labelBuf      []string
+	synced        chan struct{}
+	// Rooms commands were forwarded to since the last sync. Used only
+	// by daemon
+	forwarded     map[*Room]struct{}
 	recvTimestamp time.Time
 	sendTimestamp time.Time
 	outBuf        chan *string
@@ -51,15 +75,33 @@ type Client struct {
 	sync.Mutex
 }
 
+func init() {
+	CapRegister(&Capability{name: "away-notify"})
+	CapRegister(&Capability{name: "account-notify"})
+	CapRegister(&Capability{name: "extended-join"})
+	CapRegister(&Capability{name: "chghost"})
+	CapRegister(&Capability{name: "multi-prefix"})
+	CapRegister(&Capability{name: "userhost-in-names"})
+}
+
+// Client's visible host: its address until it is resolved.
 func (c *Client) Host() string {
-	addr := c.conn.RemoteAddr().String()
-	if host, _, err := net.SplitHostPort(addr); err == nil {
-		addr = host
-	}
-	if domains, err := net.LookupAddr(addr); err == nil {
-		addr = strings.TrimSuffix(domains[0], ".")
+	c.Lock()
+	defer c.Unlock()
+	return c.host
+}
+
+// Resolve client's address to the domain name. It is done before the
+// client is known to others, so resolved host is not a host change.
+func (c *Client) HostResolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), HostResolveTimeout)
+	defer cancel()
+	addr := c.Host()
+	if domains, err := net.DefaultResolver.LookupAddr(ctx, addr); err == nil && len(domains) > 0 {
+		c.Lock()
+		c.host = strings.TrimSuffix(domains[0], ".")
+		c.Unlock()
 	}
-	return addr
 }
 
 func (c *Client) String() string {
@@ -69,14 +111,21 @@ func (c *Client) String() string {
 func NewClient(conn net.Conn) *Client {
 	nickname := "*"
 	username := ""
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
 	c := Client{
 		conn:          conn,
+		host:          host,
 		nickname:      &nickname,
 		username:      &username,
+		caps:          make(map[string]struct{}),
 		recvTimestamp: time.Now(),
 		sendTimestamp: time.Now(),
 		alive:         true,
 		outBuf:        make(chan *string, MaxOutBuf),
+		synced:        make(chan struct{}),
 	}
 	go c.MsgSender()
 	return &c
@@ -96,18 +145,30 @@ func (c *Client) Close() {
 }
 
 // Client processor blockingly reads everything remote client sends,
-// splits messages by CRLF and send them to Daemon gorouting for processing
-// it futher. Also it can signalize that client is unavailable (disconnected).
+// splits messages by CRLF, parses and send them to Daemon gorouting for
+// processing it futher. Also it can signalize that client is unavailable (disconnected).
 func (c *Client) Processor(sink chan ClientEvent) {
-	sink <- ClientEvent{c, EventNew, ""}
+	c.HostResolve()
+	sink <- ClientEvent{c, EventNew, nil}
 	log.Println(c, "New client")
-	buf := make([]byte, BufSize*2)
+	buf := make([]byte, (MaxTagsLen+BufSize)*2)
 	var n int
 	var prev int
 	var i int
 	var err error
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if err = tlsConn.Handshake(); err != nil {
+			log.Println(c, "TLS handshake failed", err)
+			goto Finished
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			hash := sha256.Sum256(certs[0].Raw)
+			c.certfp = hex.EncodeToString(hash[:])
+			log.Println(c, "certificate fingerprint", c.certfp)
+		}
+	}
 	for {
-		if prev == BufSize {
+		if prev >= MaxTagsLen+BufSize {
 			log.Println(c, "input buffer size exceeded, kicking him")
 			break
 		}
@@ -121,13 +182,30 @@ func (c *Client) Processor(sink chan ClientEvent) {
 		if i == -1 {
 			continue
 		}
-		sink <- ClientEvent{c, EventMsg, string(buf[:i])}
+		if buf[0] == '@' && bytes.IndexByte(buf[:i], ' ') >= MaxTagsLen {
+			c.ReplyNicknamed("417", "Input line was too long")
+		} else if msg, err := ParseMessage(string(buf[:i])); err == nil {
+			if msg.tags["label"] != "" && c.CapEnabled("labeled-response") {
+				// Previous commands' replies must not get into this response
+				sink <- ClientEvent{c, EventSync, nil}
+				<-c.synced
+				c.LabelStart(msg.tags["label"])
+				sink <- ClientEvent{c, EventMsg, msg}
+				// Wait until daemon and all rooms process the command
+				sink <- ClientEvent{c, EventSync, nil}
+				<-c.synced
+				c.LabelFinish()
+			} else {
+				sink <- ClientEvent{c, EventMsg, msg}
+			}
+		}
 		copy(buf, buf[i+2:prev])
 		prev -= (i + 2)
 		goto CheckMore
 	}
+Finished:
 	c.Close()
-	sink <- ClientEvent{c, EventDel, ""}
+	sink <- ClientEvent{c, EventDel, nil}
 }
 
 func (c *Client) MsgSender() {
@@ -140,13 +218,29 @@ func (c *Client) MsgSender() {
 	}
 }
 
-// Send message as is with CRLF appended.
+// Send message as is with CRLF appended. It is the response to the
+// client's own command, so it is collected if that one is labeled.
 func (c *Client) Msg(text string) {
+	c.send(text, true)
+}
+
+// Send message not caused by the client's own command, like other
+// clients' messages and notifications. It is never collected to the
+// labeled response.
+func (c *Client) Notify(text string) {
+	c.send(text, false)
+}
+
+func (c *Client) send(text string, response bool) {
 	c.Lock()
 	defer c.Unlock()
 	if !c.alive {
 		return
 	}
+	if response && c.label != nil {
+		c.labelBuf = append(c.labelBuf, text)
+		return
+	}
 	if len(c.outBuf) == MaxOutBuf {
 		log.Println(c, "output buffer size exceeded, kicking him")
 		if c.alive {
@@ -157,6 +251,40 @@ func (c *Client) Msg(text string) {
 	c.outBuf <- &text
 }
 
+// Send message with the tags client is able to receive: all of them if
+// message-tags capability is enabled, or only ones whose own capability
+// is enabled. Messages consisting only of tags (TAGMSG) are not sent
+// to clients without message-tags at all.
+func (c *Client) MsgTagged(msg *Message) {
+	if text, ok := c.tagged(msg); ok {
+		c.Msg(text)
+	}
+}
+
+// Send message with the tags like MsgTagged, but as Notify does.
+func (c *Client) NotifyTagged(msg *Message) {
+	if text, ok := c.tagged(msg); ok {
+		c.Notify(text)
+	}
+}
+
+func (c *Client) tagged(msg *Message) (string, bool) {
+	if len(msg.tags) == 0 || c.CapEnabled("message-tags") {
+		return msg.String(), true
+	}
+	if msg.command == "TAGMSG" {
+		return "", false
+	}
+	m := *msg
+	m.tags = make(map[string]string)
+	for k, v := range msg.tags {
+		if capability, found := TagCaps[k]; found && c.CapEnabled(capability) {
+			m.tags[k] = v
+		}
+	}
+	return m.String(), true
+}
+
 // Send message from server. It has ": servername" prefix.
 func (c *Client) Reply(text string) {
 	c.Msg(":" + *hostname + " " + text)
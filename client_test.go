@@ -38,12 +38,12 @@ func TestNewClient(t *testing.T) {
 	}
 	conn.inbound <- "foo"
 	event = <-sink
-	if (event.eventType != EventMsg) || (event.text != "foo") {
+	if (event.eventType != EventMsg) || (event.msg.command != "FOO") {
 		t.Fatal("no first MSG", event)
 	}
 	conn.inbound <- "bar"
 	event = <-sink
-	if (event.eventType != EventMsg) || (event.text != "bar") {
+	if (event.eventType != EventMsg) || (event.msg.command != "BAR") {
 		t.Fatal("no second MSG", event)
 	}
 	conn.inbound <- ""
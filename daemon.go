@@ -25,6 +25,7 @@ import (
 	"net"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -46,18 +47,28 @@ var (
 	roomsM     sync.RWMutex
 	roomsGroup sync.WaitGroup
 	roomSinks  map[*Room]chan ClientEvent = make(map[*Room]chan ClientEvent)
+	// Rooms acknowledge daemon's sync events through it
+	roomsSynced chan struct{} = make(chan struct{})
 )
 
 func SendLusers(client *Client) {
 	lusers := 0
+	invisible := 0
 	clientsM.RLock()
 	for client := range clients {
-		if client.registered {
+		if !client.registered {
+			continue
+		}
+		if client.invisible {
+			invisible++
+		} else {
 			lusers++
 		}
 	}
 	clientsM.RUnlock()
-	client.ReplyNicknamed("251", fmt.Sprintf("There are %d users and 0 invisible on 1 servers", lusers))
+	client.ReplyNicknamed("251", fmt.Sprintf(
+		"There are %d users and %d invisible on 1 servers", lusers, invisible,
+	))
 }
 
 func SendMotd(client *Client) {
@@ -108,9 +119,18 @@ func SendWhois(client *Client, nicknames []string) {
 		if c.away != nil {
 			client.ReplyNicknamed("301", *c.nickname, *c.away)
 		}
+		if c.account != nil {
+			client.ReplyNicknamed("330", *c.nickname, *c.account, "is logged in as")
+		}
+		if c.certfp != "" {
+			client.ReplyNicknamed("276", *c.nickname, "has client certificate fingerprint "+c.certfp)
+		}
 		subscriptions = make([]string, 0)
 		roomsM.RLock()
 		for _, room = range rooms {
+			if room.Hidden(client) {
+				continue
+			}
 			for subscriber = range room.members {
 				if *subscriber.nickname == nickname {
 					subscriptions = append(subscriptions, *room.name)
@@ -124,116 +144,340 @@ func SendWhois(client *Client, nicknames []string) {
 	}
 }
 
-func SendList(client *Client, cols []string) {
-	var rs []string
-	var r string
-	if (len(cols) > 1) && (cols[1] != "") {
-		rs = strings.Split(strings.Split(cols[1], " ")[0], ",")
-	} else {
-		rs = make([]string, 0)
-		roomsM.RLock()
-		for r = range rooms {
-			rs = append(rs, r)
+// Send NAMES replies for the listed rooms, or for all of them and for
+// clients not visible in any room if none is listed. Hidden rooms
+// are skipped.
+func SendNames(client *Client, params []string) {
+	if len(params) > 0 && params[0] != "" {
+		for _, r := range strings.Split(params[0], ",") {
+			roomsM.RLock()
+			if room, found := rooms[RoomKey(r)]; found && !room.Hidden(client) {
+				room.SendNames(client)
+			}
+			roomsM.RUnlock()
+			client.ReplyNicknamed("366", r, "End of NAMES list")
 		}
-		roomsM.RUnlock()
+		return
 	}
-	sort.Strings(rs)
-	var room *Room
-	var found bool
-	for _, r = range rs {
-		roomsM.RLock()
-		if room, found = rooms[r]; found {
-			client.ReplyNicknamed(
-				"322",
-				r,
-				fmt.Sprintf("%d", len(room.members)),
-				*room.topic,
-			)
+	rs := make([]*Room, 0)
+	roomsM.RLock()
+	for _, room := range rooms {
+		if !room.Hidden(client) {
+			rs = append(rs, room)
 		}
-		roomsM.RUnlock()
 	}
-	client.ReplyNicknamed("323", "End of /LIST")
+	roomsM.RUnlock()
+	sort.Slice(rs, func(i, j int) bool { return rs[i].String() < rs[j].String() })
+	visible := make(map[*Client]struct{})
+	for _, room := range rs {
+		room.SendNames(client)
+		room.RLock()
+		for m := range room.members {
+			visible[m] = struct{}{}
+		}
+		room.RUnlock()
+	}
+	userhost := client.CapEnabled("userhost-in-names")
+	names := make([]string, 0)
+	clientsM.RLock()
+	for c := range clients {
+		if _, found := visible[c]; found || !c.registered || c.invisible {
+			continue
+		}
+		if userhost {
+			names = append(names, c.String())
+		} else {
+			names = append(names, *c.nickname)
+		}
+	}
+	clientsM.RUnlock()
+	sort.Strings(names)
+	ReplyNames(client, "*", "*", names)
+	client.ReplyNicknamed("366", "*", "End of NAMES list")
+}
+
+// Passwords file entry: login, password and optional list of allowed
+// TLS client certificates fingerprints.
+type Account struct {
+	login        string
+	password     string
+	fingerprints []string
+}
+
+// Read all accounts from passwords file.
+func AccountsRead() []*Account {
+	contents, err := ioutil.ReadFile(*passwords)
+	if err != nil {
+		log.Fatalf("Can no read passwords file %s: %s", *passwords, err)
+	}
+	accounts := make([]*Account, 0)
+	for _, entry := range strings.Split(string(contents), "\n") {
+		if entry == "" {
+			continue
+		}
+		lp := strings.Split(entry, ":")
+		if len(lp) < 2 {
+			continue
+		}
+		account := Account{login: lp[0], password: lp[1]}
+		if len(lp) > 2 && lp[2] != "" {
+			account.fingerprints = strings.Split(strings.ToLower(lp[2]), ",")
+		}
+		accounts = append(accounts, &account)
+	}
+	return accounts
+}
+
+// Find account with specified login in passwords file.
+func AccountLookup(login string) *Account {
+	for _, account := range AccountsRead() {
+		if account.login == login {
+			return account
+		}
+	}
+	return nil
+}
+
+// Find registered client by his nickname.
+func ClientFind(nickname string) *Client {
+	nickname = strings.ToLower(nickname)
+	clientsM.RLock()
+	defer clientsM.RUnlock()
+	for c := range clients {
+		if c.registered && *c.nickname == nickname {
+			return c
+		}
+	}
+	return nil
+}
+
+// Check if requested nickname is valid and is not used by anyone else.
+// Corresponding error is replied to the client otherwise. Nickname is
+// returned lowercased.
+func NicknameCheck(client *Client, requested string) (string, bool) {
+	nickname := strings.ToLower(requested)
+	clientsM.RLock()
+	for existingClient := range clients {
+		if *existingClient.nickname == nickname {
+			clientsM.RUnlock()
+			client.ReplyParts("433", *client.nickname, nickname, "Nickname is already in use")
+			return "", false
+		}
+	}
+	clientsM.RUnlock()
+	if !RENickname.MatchString(nickname) {
+		client.ReplyParts("432", *client.nickname, requested, "Erroneous nickname")
+		return "", false
+	}
+	return nickname, true
+}
+
+// Find everyone sharing a room with the client, including himself, and
+// names of the rooms he is subscribed to.
+func ClientPeers(client *Client) (map[*Client]struct{}, []string) {
+	peers := map[*Client]struct{}{client: struct{}{}}
+	subscriptions := make([]string, 0)
+	roomsM.RLock()
+	for name, room := range rooms {
+		room.RLock()
+		if _, subscribed := room.members[client]; subscribed {
+			subscriptions = append(subscriptions, name)
+			for member := range room.members {
+				peers[member] = struct{}{}
+			}
+		}
+		room.RUnlock()
+	}
+	roomsM.RUnlock()
+	return peers, subscriptions
+}
+
+// Send message to everyone sharing a room with the client and having
+// the capability enabled. The client himself is notified if withSelf.
+func PeersNotify(client *Client, capability, msg string, withSelf bool) {
+	peers, _ := ClientPeers(client)
+	if !withSelf {
+		delete(peers, client)
+	}
+	for peer := range peers {
+		if peer.CapEnabled(capability) {
+			peer.Notify(msg)
+		}
+	}
+}
+
+// Change visible host of the client, for example to the cloak. Must be
+// called from the daemon. Registered clients and their peers with chghost
+// capability are notified.
+func HostChange(client *Client, host string) {
+	client.Lock()
+	hostOld := client.host
+	client.host = host
+	client.Unlock()
+	if hostOld == host || !client.registered {
+		return
+	}
+	PeersNotify(client, "chghost", fmt.Sprintf(
+		":%s!%s@%s CHGHOST %s %s",
+		*client.nickname,
+		*client.username,
+		hostOld,
+		*client.username,
+		host,
+	), true)
+}
+
+// Query or change client's own modes. Only invisibility (+i) is
+// supported: invisible clients are not counted in LUSERS and are not
+// shown in NAMES outside of rooms.
+func HandlerUserMode(client *Client, params []string) {
+	if len(params) == 0 {
+		modes := "+"
+		if client.invisible {
+			modes += "i"
+		}
+		client.ReplyNicknamed("221", modes)
+		return
+	}
+	sign := "+"
+	var changes string
+	var changesSign string
+	unknown := false
+	for _, mode := range params[0] {
+		switch mode {
+		case '+', '-':
+			sign = string(mode)
+		case 'i':
+			if client.invisible == (sign == "+") {
+				continue
+			}
+			client.invisible = sign == "+"
+			if changesSign != sign {
+				changes += sign
+				changesSign = sign
+			}
+			changes += string(mode)
+		default:
+			unknown = true
+		}
+	}
+	if unknown {
+		client.ReplyNicknamed("501", "Unknown MODE flag")
+	}
+	if changes != "" {
+		client.Msg(fmt.Sprintf(":%s MODE %s :%s", client, *client.nickname, changes))
+	}
+}
+
+// Change nickname of the registered client. Everyone sharing a room with
+// him is notified exactly once and the change is logged in each of
+// those rooms.
+func HandlerNick(client *Client, requested string) {
+	if strings.ToLower(requested) == *client.nickname {
+		return
+	}
+	nickname, ok := NicknameCheck(client, requested)
+	if !ok {
+		return
+	}
+	// Nicknames of the accounts are taken only by their owners
+	if passwords != nil && *passwords != "" &&
+		(client.account == nil || *client.account != nickname) &&
+		AccountLookup(nickname) != nil {
+		client.ReplyParts("433", *client.nickname, nickname, "Nickname is reserved by an account")
+		return
+	}
+	peers, subscriptions := ClientPeers(client)
+	msg := fmt.Sprintf(":%s NICK :%s", client, nickname)
+	WhowasAdd(client)
+	nicknameOld := *client.nickname
+	client.nickname = &nickname
+	for peer := range peers {
+		if peer == client {
+			peer.Msg(msg)
+		} else {
+			peer.Notify(msg)
+		}
+	}
+	MonitorNotify(nicknameOld, "")
+	MonitorNotify(nickname, client.String())
+	for _, name := range subscriptions {
+		logSink <- LogEvent{
+			name,
+			nicknameOld,
+			"is now known as " + nickname,
+			true,
+			NewMsgID(),
+			time.Now(),
+			"",
+		}
+	}
+	log.Println(nicknameOld, "is now known as", nickname)
 }
 
 // Unregistered client workflow processor. Unregistered client:
 // * is not PINGed
-// * only QUIT, NICK and USER commands are processed
+// * only QUIT, CAP, AUTHENTICATE, PASS, NICK and USER commands are processed
 // * other commands are quietly ignored
 // When client finishes NICK/USER workflow, then MOTD and LUSERS are send to him.
-func ClientRegister(client *Client, cmd string, cols []string) {
-	switch cmd {
+func ClientRegister(client *Client, msg *Message) {
+	switch msg.command {
+	case "AUTHENTICATE":
+		HandlerAuthenticate(client, msg)
+	case "CAP":
+		HandlerCap(client, msg)
 	case "PASS":
-		if len(cols) == 1 || len(cols[1]) < 1 {
+		if msg.Param(0) == "" {
 			client.ReplyNotEnoughParameters("PASS")
 			return
 		}
-		password := strings.TrimPrefix(cols[1], ":")
+		password := msg.params[0]
 		client.password = &password
 	case "NICK":
-		if len(cols) == 1 || len(cols[1]) < 1 {
+		if msg.Param(0) == "" {
 			client.ReplyParts("431", "No nickname given")
 			return
 		}
-		nickname := cols[1]
-		// Compatibility with some clients prepending colons to nickname
-		nickname = strings.TrimPrefix(nickname, ":")
-		nickname = strings.ToLower(nickname)
-		clientsM.RLock()
-		for existingClient := range clients {
-			if *existingClient.nickname == nickname {
-				clientsM.RUnlock()
-				client.ReplyParts("433", "*", nickname, "Nickname is already in use")
-				return
-			}
-		}
-		clientsM.RUnlock()
-		if !RENickname.MatchString(nickname) {
-			client.ReplyParts("432", "*", cols[1], "Erroneous nickname")
+		nickname, ok := NicknameCheck(client, msg.params[0])
+		if !ok {
 			return
 		}
 		client.nickname = &nickname
 	case "USER":
-		if len(cols) == 1 {
+		if len(msg.params) < 4 || msg.params[0] == "" {
 			client.ReplyNotEnoughParameters("USER")
 			return
 		}
-		args := strings.SplitN(cols[1], " ", 4)
-		if len(args) < 4 {
-			client.ReplyNotEnoughParameters("USER")
-			return
-		}
-		client.username = &args[0]
-		realname := strings.TrimLeft(args[3], ":")
+		username := msg.params[0]
+		realname := msg.params[3]
+		client.username = &username
 		client.realname = &realname
 	}
-	if *client.nickname != "*" && *client.username != "" {
+	if *client.nickname != "*" && *client.username != "" && !client.negotiating {
 		if passwords != nil && *passwords != "" {
-			if client.password == nil {
+			if client.account == nil && client.password == nil {
 				client.ReplyParts("462", "You may not register")
 				client.Close()
 				return
 			}
-			contents, err := ioutil.ReadFile(*passwords)
-			if err != nil {
-				log.Fatalf("Can no read passwords file %s: %s", *passwords, err)
-				return
+			account := AccountLookup(*client.nickname)
+			if client.account != nil && *client.account == *client.nickname {
+				// Account's nickname is already authenticated with SASL
+				account = nil
 			}
-			for _, entry := range strings.Split(string(contents), "\n") {
-				if entry == "" {
-					continue
-				}
-				if lp := strings.Split(entry, ":"); lp[0] == *client.nickname && lp[1] != *client.password {
-					client.ReplyParts("462", "You may not register")
-					client.Close()
-					return
-				}
+			if account != nil && (client.password == nil || !PasswordCheck(account.password, *client.password)) {
+				client.ReplyParts("462", "You may not register")
+				client.Close()
+				return
 			}
 		}
 		client.registered = true
+		MonitorNotify(*client.nickname, client.String())
 		client.ReplyNicknamed("001", "Hi, welcome to IRC")
 		client.ReplyNicknamed("002", "Your host is "+*hostname+", running goircd "+version)
 		client.ReplyNicknamed("003", "This server was created sometime")
-		client.ReplyNicknamed("004", *hostname+" goircd o o")
+		SendMyInfo(client)
+		SendISupport(client)
 		SendLusers(client)
 		SendMotd(client)
 		log.Println(client, "logged in")
@@ -246,7 +490,7 @@ func RoomRegister(name string) (*Room, chan ClientEvent) {
 	roomNew := NewRoom(name)
 	roomSink := make(chan ClientEvent)
 	roomsM.Lock()
-	rooms[name] = roomNew
+	rooms[RoomKey(name)] = roomNew
 	roomSinks[roomNew] = roomSink
 	roomsM.Unlock()
 	go roomNew.Processor(roomSink)
@@ -254,12 +498,23 @@ func RoomRegister(name string) (*Room, chan ClientEvent) {
 	return roomNew, roomSink
 }
 
-func HandlerJoin(client *Client, cmd string) {
-	args := strings.Split(cmd, " ")
-	rs := strings.Split(args[0], ",")
+// Send client's event to the room. Rooms commands are forwarded to are
+// remembered to be synced with around the labeled response.
+func RoomForward(room *Room, roomSink chan ClientEvent, event ClientEvent) {
+	if event.client.CapEnabled("labeled-response") {
+		if event.client.forwarded == nil {
+			event.client.forwarded = make(map[*Room]struct{})
+		}
+		event.client.forwarded[room] = struct{}{}
+	}
+	roomSink <- event
+}
+
+func HandlerJoin(client *Client, params []string) {
+	rs := strings.Split(params[0], ",")
 	var keys []string
-	if len(args) > 1 {
-		keys = strings.Split(args[1], ",")
+	if len(params) > 1 {
+		keys = strings.Split(params[1], ",")
 	} else {
 		keys = make([]string, 0)
 	}
@@ -279,12 +534,24 @@ func HandlerJoin(client *Client, cmd string) {
 		}
 		roomsM.RLock()
 		for roomExisting, roomSink = range roomSinks {
-			if room == *roomExisting.name {
+			if RoomKey(room) == RoomKey(*roomExisting.name) {
 				roomsM.RUnlock()
 				if (*roomExisting.key != "") && (*roomExisting.key != key) {
 					goto Denied
 				}
-				roomSink <- ClientEvent{client, EventNew, ""}
+				if roomExisting.Full() {
+					client.ReplyNicknamed("471", room, "Cannot join channel (+l)")
+					goto Joined
+				}
+				if roomExisting.InviteNeeded(client) {
+					client.ReplyNicknamed("473", room, "Cannot join channel (+i)")
+					goto Joined
+				}
+				if roomExisting.Banned(client) {
+					client.ReplyNicknamed("474", room, "Cannot join channel (+b)")
+					goto Joined
+				}
+				RoomForward(roomExisting, roomSink, ClientEvent{client, EventNew, nil})
 				goto Joined
 			}
 		}
@@ -295,7 +562,7 @@ func HandlerJoin(client *Client, cmd string) {
 			roomNew.key = &key
 			roomNew.StateSave()
 		}
-		roomSink <- ClientEvent{client, EventNew, ""}
+		RoomForward(roomNew, roomSink, ClientEvent{client, EventNew, nil})
 		continue
 	Denied:
 		client.ReplyNicknamed("475", room, "Cannot join channel (+k) - bad key")
@@ -325,7 +592,7 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 				}
 				if c.sendTimestamp.Add(PingThreshold).Before(now) {
 					if c.registered {
-						c.Msg("PING :" + *hostname)
+						c.Notify("PING :" + *hostname)
 						c.sendTimestamp = time.Now()
 					} else {
 						log.Println(c, "ping timeout")
@@ -357,18 +624,37 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 			clientsM.Lock()
 			clients[client] = struct{}{}
 			clientsM.Unlock()
+		case EventSync:
+			for room := range client.forwarded {
+				// Emptied room could be already removed
+				roomsM.RLock()
+				roomSink, found := roomSinks[room]
+				roomsM.RUnlock()
+				if !found {
+					continue
+				}
+				roomSink <- event
+				<-roomsSynced
+			}
+			client.forwarded = nil
+			client.synced <- struct{}{}
 		case EventDel:
 			clientsM.Lock()
 			delete(clients, client)
 			clientsM.Unlock()
+			MonitorRemove(client, "")
+			if client.registered {
+				MonitorNotify(*client.nickname, "")
+				WhowasAdd(client)
+			}
 			roomsM.RLock()
 			for _, roomSink := range roomSinks {
 				roomSink <- event
 			}
 			roomsM.RUnlock()
 		case EventMsg:
-			cols := strings.SplitN(event.text, " ", 2)
-			cmd := strings.ToUpper(cols[0])
+			msg := event.msg
+			cmd := msg.command
 			if *verbose {
 				log.Println(client, "command", cmd)
 			}
@@ -378,7 +664,7 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 				continue
 			}
 			if !client.registered {
-				ClientRegister(client, cmd, cols)
+				ClientRegister(client, msg)
 				continue
 			}
 			if client != nil {
@@ -386,160 +672,204 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 			}
 			switch cmd {
 			case "AWAY":
-				if len(cols) == 1 {
+				if msg.Param(0) == "" {
 					client.away = nil
 					client.ReplyNicknamed("305", "You are no longer marked as being away")
+					PeersNotify(client, "away-notify", fmt.Sprintf(":%s AWAY", client), false)
 					continue
 				}
-				msg := strings.TrimLeft(cols[1], ":")
-				client.away = &msg
+				away := msg.params[0]
+				client.away = &away
 				client.ReplyNicknamed("306", "You have been marked as being away")
+				PeersNotify(client, "away-notify", fmt.Sprintf(":%s AWAY :%s", client, away), false)
+			case "ADMIN":
+				SendAdmin(client)
+			case "AUTHENTICATE":
+				HandlerAuthenticate(client, msg)
+			case "CAP":
+				HandlerCap(client, msg)
+			case "CHATHISTORY":
+				HandlerChatHistory(client, msg)
+			case "HELP", "HELPOP":
+				SendHelp(client, msg.Param(0))
+			case "INFO":
+				SendInfo(client)
+			case "INVITE":
+				if len(msg.params) < 2 {
+					client.ReplyNotEnoughParameters("INVITE")
+					continue
+				}
+				roomsM.RLock()
+				if r, found := rooms[RoomKey(msg.params[1])]; found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventInvite, msg})
+				} else {
+					client.ReplyNoChannel(msg.params[1])
+				}
+				roomsM.RUnlock()
 			case "JOIN":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("JOIN")
 					continue
 				}
-				HandlerJoin(client, cols[1])
+				HandlerJoin(client, msg.params)
+			case "KICK":
+				if len(msg.params) < 2 {
+					client.ReplyNotEnoughParameters("KICK")
+					continue
+				}
+				roomsM.RLock()
+				if r, found := rooms[RoomKey(msg.params[0])]; found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventKick, msg})
+				} else {
+					client.ReplyNoChannel(msg.params[0])
+				}
+				roomsM.RUnlock()
 			case "LIST":
-				SendList(client, cols)
+				SendList(client, msg.params)
 			case "LUSERS":
 				SendLusers(client)
 			case "MODE":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("MODE")
 					continue
 				}
-				cols = strings.SplitN(cols[1], " ", 2)
-				if cols[0] == *client.username {
-					if len(cols) == 1 {
-						client.Msg("221 " + *client.nickname + " +")
-					} else {
-						client.ReplyNicknamed("501", "Unknown MODE flag")
-					}
+				if strings.ToLower(msg.params[0]) == *client.nickname {
+					HandlerUserMode(client, msg.params[1:])
 					continue
 				}
-				room := cols[0]
+				room := msg.params[0]
 				roomsM.RLock()
-				r, found := rooms[room]
-				if !found {
-					client.ReplyNoChannel(room)
-					roomsM.RUnlock()
-					continue
-				}
-				if len(cols) == 1 {
-					roomSinks[r] <- ClientEvent{client, EventMode, ""}
+				if r, found := rooms[RoomKey(room)]; found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventMode, msg})
 				} else {
-					roomSinks[r] <- ClientEvent{client, EventMode, cols[1]}
+					client.ReplyNoChannel(room)
 				}
 				roomsM.RUnlock()
+			case "MONITOR":
+				HandlerMonitor(client, msg.params)
+			case "NAMES":
+				SendNames(client, msg.params)
 			case "MOTD":
 				SendMotd(client)
+			case "NICK":
+				if msg.Param(0) == "" {
+					client.ReplyNicknamed("431", "No nickname given")
+					continue
+				}
+				HandlerNick(client, msg.params[0])
 			case "PART":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("PART")
 					continue
 				}
-				rs := strings.Split(cols[1], " ")[0]
 				roomsM.RLock()
-				for _, room := range strings.Split(rs, ",") {
-					if r, found := rooms[room]; found {
-						roomSinks[r] <- ClientEvent{client, EventDel, ""}
+				for _, room := range strings.Split(msg.params[0], ",") {
+					if r, found := rooms[RoomKey(room)]; found {
+						RoomForward(r, roomSinks[r], ClientEvent{client, EventDel, msg})
 					} else {
 						client.ReplyNoChannel(room)
 					}
 				}
 				roomsM.RUnlock()
 			case "PING":
-				if len(cols) == 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNicknamed("409", "No origin specified")
 					continue
 				}
-				client.Reply(fmt.Sprintf("PONG %s :%s", *hostname, cols[1]))
+				client.Reply(fmt.Sprintf("PONG %s :%s", *hostname, msg.params[0]))
 			case "PONG":
 				continue
-			case "NOTICE", "PRIVMSG":
-				if len(cols) == 1 {
+			case "NOTICE", "PRIVMSG", "TAGMSG":
+				if msg.Param(0) == "" {
 					client.ReplyNicknamed("411", "No recipient given ("+cmd+")")
 					continue
 				}
-				cols = strings.SplitN(cols[1], " ", 2)
-				if len(cols) == 1 {
+				if cmd != "TAGMSG" && msg.Param(1) == "" {
 					client.ReplyNicknamed("412", "No text to send")
 					continue
 				}
-				msg := ""
-				target := strings.ToLower(cols[0])
-				clientsM.RLock()
-				for c := range clients {
-					if *c.nickname == target {
-						msg = fmt.Sprintf(":%s %s %s %s", client, cmd, *c.nickname, cols[1])
-						c.Msg(msg)
-						if c.away != nil {
-							client.ReplyNicknamed("301", *c.nickname, *c.away)
-						}
-						break
+				target := strings.ToLower(msg.params[0])
+				if c := ClientFind(target); c != nil {
+					var relay *Message
+					if cmd == "TAGMSG" {
+						relay = NewMessage(client.String(), cmd, *c.nickname)
+					} else {
+						relay = NewMessage(client.String(), cmd, *c.nickname, msg.params[1])
+						relay.trailing = true
+					}
+					relay.tags = msg.ClientTags()
+					relay.Stamp(time.Now())
+					c.NotifyTagged(relay)
+					if client.CapEnabled("echo-message") {
+						client.MsgTagged(relay)
+					}
+					if cmd != "TAGMSG" && c.away != nil {
+						client.ReplyNicknamed("301", *c.nickname, *c.away)
 					}
-				}
-				clientsM.RUnlock()
-				if msg != "" {
 					continue
 				}
 				roomsM.RLock()
-				if r, found := rooms[target]; found {
-					roomSinks[r] <- ClientEvent{
-						client,
-						EventMsg,
-						cmd + " " + strings.TrimLeft(cols[1], ":"),
-					}
+				if r, found := rooms[RoomKey(target)]; found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventMsg, msg})
 				} else {
 					client.ReplyNoNickChan(target)
 				}
 				roomsM.RUnlock()
+			case "TIME":
+				SendTime(client)
 			case "TOPIC":
-				if len(cols) == 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("TOPIC")
 					continue
 				}
-				cols = strings.SplitN(cols[1], " ", 2)
 				roomsM.RLock()
-				r, found := rooms[cols[0]]
-				roomsM.RUnlock()
-				if !found {
-					client.ReplyNoChannel(cols[0])
-					continue
-				}
-				var change string
-				if len(cols) > 1 {
-					change = cols[1]
+				if r, found := rooms[RoomKey(msg.params[0])]; found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventTopic, msg})
 				} else {
-					change = ""
+					client.ReplyNoChannel(msg.params[0])
 				}
-				roomsM.RLock()
-				roomSinks[r] <- ClientEvent{client, EventTopic, change}
 				roomsM.RUnlock()
+			case "USERHOST", "USERIP":
+				if msg.Param(0) == "" {
+					client.ReplyNotEnoughParameters(cmd)
+					continue
+				}
+				SendUserhost(client, strings.Fields(strings.Join(msg.params, " ")), cmd == "USERIP")
 			case "WHO":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("WHO")
 					continue
 				}
-				room := strings.Split(cols[1], " ")[0]
 				roomsM.RLock()
-				if r, found := rooms[room]; found {
-					roomSinks[r] <- ClientEvent{client, EventWho, ""}
-				} else {
-					client.ReplyNoChannel(room)
+				r, found := rooms[RoomKey(msg.params[0])]
+				if found {
+					RoomForward(r, roomSinks[r], ClientEvent{client, EventWho, msg})
 				}
 				roomsM.RUnlock()
+				if found {
+					continue
+				}
+				if strings.HasPrefix(msg.params[0], "#") {
+					client.ReplyNoChannel(msg.params[0])
+				} else {
+					SendWho(client, msg.params[0], WhoOptionsParse(msg.Param(1)))
+				}
 			case "WHOIS":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("WHOIS")
 					continue
 				}
-				cols := strings.Split(cols[1], " ")
-				nicknames := strings.Split(cols[len(cols)-1], ",")
+				nicknames := strings.Split(msg.params[len(msg.params)-1], ",")
 				SendWhois(client, nicknames)
+			case "WHOWAS":
+				if msg.Param(0) == "" {
+					client.ReplyNicknamed("431", "No nickname given")
+					continue
+				}
+				count, _ := strconv.Atoi(msg.Param(1))
+				SendWhowas(client, strings.Split(msg.params[0], ","), count)
 			case "ISON":
-				if len(cols) == 1 || len(cols[1]) < 1 {
+				if msg.Param(0) == "" {
 					client.ReplyNotEnoughParameters("ISON")
 					continue
 				}
@@ -550,7 +880,7 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 				}
 				clientsM.RUnlock()
 				var nicksExists []string
-				for _, nickname := range strings.Split(cols[1], " ") {
+				for _, nickname := range strings.Fields(strings.Join(msg.params, " ")) {
 					if _, exists := nicksKnown[nickname]; exists {
 						nicksExists = append(nicksExists, nickname)
 					}
@@ -564,6 +894,7 @@ func Processor(events chan ClientEvent, finished chan struct{}) {
 					debug = ""
 				}
 				client.ReplyNicknamed("351", fmt.Sprintf("%s.%s %s :", version, debug, *hostname))
+				SendISupport(client)
 			default:
 				client.ReplyNicknamed("421", cmd, "Unknown command")
 			}
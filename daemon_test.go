@@ -29,10 +29,17 @@ func TestRegistrationWorkflow(t *testing.T) {
 	host := "foohost"
 	hostname = &host
 	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
 	defer func() {
 		events <- ClientEvent{eventType: EventTerm}
+		<-finished
 	}()
-	go Processor(events, make(chan struct{}))
+	go Processor(events, finished)
 	conn := NewTestingConn()
 	client := NewClient(conn)
 	go client.Processor(events)
@@ -44,7 +51,7 @@ func TestRegistrationWorkflow(t *testing.T) {
 		t.Fatal("431 for NICK", r)
 	}
 
-	for _, n := range []string{"привет", " foo", "#foo", "mein nick", "foo_bar"} {
+	for _, n := range []string{"привет", "#foo", "foo.bar", "foo_bar"} {
 		conn.inbound <- "NICK " + n
 		if r := <-conn.outbound; r != ":foohost 432 * "+n+" :Erroneous nickname\r\n" {
 			t.Fatal("nickname validation", r)
@@ -79,9 +86,17 @@ func TestRegistrationWorkflow(t *testing.T) {
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 003") {
 		t.Fatal("003 after registration", r)
 	}
-	if r := <-conn.outbound; !strings.Contains(r, ":foohost 004") {
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 004 meinick foohost goircd-") ||
+		!strings.HasSuffix(r, " i HIbeiklmnopstv beHIklov\r\n") {
 		t.Fatal("004 after registration", r)
 	}
+	if r := <-conn.outbound; !strings.Contains(r, ":foohost 005 meinick CASEMAPPING=ascii ") {
+		t.Fatal("005 after registration", r)
+	}
+	if r := <-conn.outbound; !strings.Contains(r, " TOPICLEN=390 ") ||
+		!strings.HasSuffix(r, " :are supported by this server\r\n") {
+		t.Fatal("second 005 after registration", r)
+	}
 	if r := <-conn.outbound; !strings.Contains(r, ":foohost 251") {
 		t.Fatal("251 after registration", r)
 	}
@@ -138,3 +153,124 @@ func TestMotd(t *testing.T) {
 		t.Fatalf("MOTD end: got %q, want prefix %q", got, want)
 	}
 }
+
+func TestNickChange(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo,#bar"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo,#bar"
+	for i := 0; i < 8; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	<-conn1.outbound
+	for i := 0; i < 4; i++ {
+		<-logSink
+	}
+
+	conn1.inbound <- "NICK nick2"
+	if r := <-conn1.outbound; r != ":foohost 433 nick1 nick2 :Nickname is already in use\r\n" {
+		t.Fatal("nickname collision", r)
+	}
+	conn1.inbound <- "NICK nick_1"
+	if r := <-conn1.outbound; r != ":foohost 432 nick1 nick_1 :Erroneous nickname\r\n" {
+		t.Fatal("erroneous nickname", r)
+	}
+	conn1.inbound <- "NICK nick3"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient NICK :nick3\r\n" {
+		t.Fatal("NICK for himself", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient NICK :nick3\r\n" {
+		t.Fatal("NICK for peer", r)
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-logSink; r.who != "nick1" || r.what != "is now known as nick3" || !r.meta {
+			t.Fatal("NICK log", r)
+		}
+	}
+	conn2.inbound <- "PING foo"
+	if r := <-conn2.outbound; r != ":foohost PONG foohost :foo\r\n" {
+		t.Fatal("NICK is sent twice", r)
+	}
+	if *client1.nickname != "nick3" {
+		t.Fatal("nickname is not changed", *client1.nickname)
+	}
+}
+
+func TestUserMode(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 8; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "MODE nick1 +iw"
+	if r := <-conn.outbound; r != ":foohost 501 nick1 :Unknown MODE flag\r\n" {
+		t.Fatal("unknown user mode", r)
+	}
+	if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE nick1 :+i\r\n" {
+		t.Fatal("user mode change", r)
+	}
+	conn.inbound <- "MODE nick1"
+	if r := <-conn.outbound; r != ":foohost 221 nick1 :+i\r\n" {
+		t.Fatal("user mode query", r)
+	}
+	conn.inbound <- "LUSERS"
+	if r := <-conn.outbound; !strings.Contains(r, "There are 0 users and 1 invisible") {
+		t.Fatal("LUSERS with invisible", r)
+	}
+	conn.inbound <- "MODE nick1 +i"
+	conn.inbound <- "MODE nick1 -i"
+	if r := <-conn.outbound; r != ":nick1!foo1@someclient MODE nick1 :-i\r\n" {
+		t.Fatal("user mode removal", r)
+	}
+}
@@ -28,16 +28,20 @@ import (
 )
 
 const (
-	EventNew   = iota
-	EventDel   = iota
-	EventMsg   = iota
-	EventTopic = iota
-	EventWho   = iota
-	EventMode  = iota
-	EventTerm  = iota
-	EventTick  = iota
-	FormatMsg  = "[%s] <%s> %s\n"
-	FormatMeta = "[%s] * %s %s\n"
+	EventNew     = iota
+	EventDel     = iota
+	EventMsg     = iota
+	EventTopic   = iota
+	EventWho     = iota
+	EventMode    = iota
+	EventKick    = iota
+	EventInvite  = iota
+	EventTerm    = iota
+	EventTick    = iota
+	EventSync    = iota
+	FormatMsg    = "[%s] %s <%s> %s\n"
+	FormatNotice = "[%s] %s -%s- %s\n"
+	FormatMeta   = "[%s] %s * %s %s\n"
 )
 
 var (
@@ -46,24 +50,30 @@ var (
 )
 
 // Client events going from each of client
-// They can be either NEW, DEL or unparsed MSG
+// They can be either NEW, DEL or parsed MSG. Events passed to rooms
+// carry the message of the command they were caused by.
 type ClientEvent struct {
 	client    *Client
 	eventType int
-	text      string
+	msg       *Message
 }
 
 func (m ClientEvent) String() string {
-	return string(m.eventType) + ": " + m.client.String() + ": " + m.text
+	return fmt.Sprintf("%d: %s: %s", m.eventType, m.client, m.msg)
 }
 
 // Logging in-room events
 // Intended to tell when, where and who send a message or meta command
+// The msgid is the same one relayed message was tagged with
+// The command is PRIVMSG or NOTICE for messages and empty for meta ones
 type LogEvent struct {
-	where string
-	who   string
-	what  string
-	meta  bool
+	where   string
+	who     string
+	what    string
+	meta    bool
+	msgid   string
+	when    time.Time
+	command string
 }
 
 // Logging events logger itself
@@ -83,12 +93,21 @@ func Logger(logdir string, events <-chan LogEvent) {
 			log.Println("Can not open logfile", logfile, err)
 			continue
 		}
-		if event.meta {
+		switch {
+		case event.meta:
 			format = FormatMeta
-		} else {
+		case event.command == "NOTICE":
+			format = FormatNotice
+		default:
 			format = FormatMsg
 		}
-		_, err = fd.WriteString(fmt.Sprintf(format, time.Now(), event.who, event.what))
+		_, err = fd.WriteString(fmt.Sprintf(
+			format,
+			event.when.UTC().Format(time.RFC3339Nano),
+			event.msgid,
+			event.who,
+			event.what,
+		))
 		fd.Close()
 		if err != nil {
 			log.Println("Error writing to logfile", logfile, err)
@@ -97,13 +116,17 @@ func Logger(logdir string, events <-chan LogEvent) {
 }
 
 type StateEvent struct {
-	where string
-	topic string
-	key   string
+	where    string
+	topic    string
+	key      string
+	modes    string
+	created  time.Time
+	topicSet time.Time
+	masks    []string
 }
 
 // Room state events saver
-// Room states shows that either topic or key has been changed
+// Room states shows that either topic, key, modes or masks lists have been changed
 // Each room's state is written to separate file in statedir
 func StateKeeper(statedir string, events <-chan StateEvent) {
 	var fn string
@@ -111,7 +134,14 @@ func StateKeeper(statedir string, events <-chan StateEvent) {
 	var err error
 	for event := range events {
 		fn = path.Join(statedir, event.where)
-		data = event.topic + "\n" + event.key + "\n"
+		data = event.topic + "\n" + event.key + "\n" + event.modes + "\n"
+		data += fmt.Sprintf("C %d\n", event.created.Unix())
+		if !event.topicSet.IsZero() {
+			data += fmt.Sprintf("T %d\n", event.topicSet.Unix())
+		}
+		for _, mask := range event.masks {
+			data += mask + "\n"
+		}
 		err = ioutil.WriteFile(fn, []byte(data), os.FileMode(0660))
 		if err != nil {
 			log.Printf("Can not write statefile %s: %v", fn, err)
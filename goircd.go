@@ -39,7 +39,13 @@ var (
 	passwords = flag.String("passwords", "", "Optional path to passwords file")
 	tlsBind   = flag.String("tlsbind", "", "TLS address to bind to")
 	tlsPEM    = flag.String("tlspem", "", "Path to TLS certificat+key PEM file")
+	tlsClient = flag.Bool("tlsclient", false, "Request TLS client certificates")
+	monLimit  = flag.Int("monitorlimit", 100, "Maximal number of monitored nicknames")
 	verbose   = flag.Bool("v", false, "Enable verbose logging.")
+
+	adminLoc1  = flag.String("adminloc1", "", "ADMIN server's location")
+	adminLoc2  = flag.String("adminloc2", "", "ADMIN server's organization")
+	adminEmail = flag.String("adminemail", "", "ADMIN administrator's e-mail")
 )
 
 func listenerLoop(sock net.Listener, events chan ClientEvent) {
@@ -58,19 +64,22 @@ func Run() {
 	events := make(chan ClientEvent)
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 
+	logEvents := make(chan LogEvent)
 	if *logdir == "" {
 		// Dummy logger
 		go func() {
-			for _ = range logSink {
+			for _ = range logEvents {
 			}
 		}()
 	} else {
 		if !path.IsAbs(*logdir) {
 			log.Fatalln("Need absolute path for logdir")
 		}
-		go Logger(*logdir, logSink)
+		HistoryLoad(*logdir)
+		go Logger(*logdir, logEvents)
 		log.Println(*logdir, "logger initialized")
 	}
+	go HistoryKeeper(logSink, logEvents)
 
 	log.Println("goircd " + version + " is starting")
 	if *statedir == "" {
@@ -97,13 +106,18 @@ func Run() {
 			if len(contents) < 2 {
 				log.Printf("State corrupted for %s: %q", *room.name, contents)
 			} else {
-				room.topic = &contents[0]
-				room.key = &contents[1]
+				room.StateRestore(contents)
 				log.Println("Loaded state for room", *room.name)
 			}
 		}
 		go StateKeeper(*statedir, stateSink)
 		log.Println(*statedir, "statekeeper initialized")
+		fn := path.Join(*statedir, WhowasFile)
+		if buf, err := ioutil.ReadFile(fn); err == nil {
+			WhowasRestore(strings.Split(string(buf), "\n"))
+			log.Println("Loaded whowas from", fn)
+		}
+		go WhowasKeeper(fn, whowasSink)
 	}
 
 	if *bind != "" {
@@ -120,6 +134,10 @@ func Run() {
 			log.Fatalf("Could not load TLS keys from %s: %s", *tlsPEM, err)
 		}
 		config := tls.Config{Certificates: []tls.Certificate{cert}}
+		if *tlsClient {
+			// Certificates are checked by fingerprints in passwords file
+			config.ClientAuth = tls.RequestClientCert
+		}
 		listenerTLS, err := tls.Listen("tcp", *tlsBind, &config)
 		if err != nil {
 			log.Fatalf("Can not listen on %s: %v", *tlsBind, err)
@@ -132,5 +150,9 @@ func Run() {
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "passwd" {
+		Passwd(flag.Args()[1:])
+		return
+	}
 	Run()
 }
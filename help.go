@@ -0,0 +1,140 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Help texts of the commands shown by HELP. The first line is the
+// command's syntax.
+var HelpTexts = map[string]string{
+	"ADMIN": `ADMIN
+Shows administrative information about the server.`,
+	"AUTHENTICATE": `AUTHENTICATE <mechanism|data>
+Performs SASL authentication. PLAIN and EXTERNAL mechanisms
+are supported. Requires the sasl capability.`,
+	"AWAY": `AWAY [:<message>]
+Marks you as being away with the message, or removes the mark
+if no message is given.`,
+	"CAP": `CAP <LS|LIST|REQ|END> [<version>|:<capabilities>]
+Negotiates IRCv3 capabilities.`,
+	"CHATHISTORY": `CHATHISTORY <LATEST|BEFORE|AFTER|AROUND|BETWEEN> <#room> <reference> [<reference>] <limit>
+Requests the room's messages history. References are msgid=ID,
+timestamp=TIME or * for LATEST.`,
+	"HELP": `HELP [<subject>]
+Shows help on the command, or the list of commands if no
+subject is given. HELPOP is its alias.`,
+	"INFO": `INFO
+Shows information about the server's software.`,
+	"INVITE": `INVITE <nickname> <#room>
+Invites the user to the room.`,
+	"ISON": `ISON <nickname> [<nickname> ...]
+Shows which of the nicknames are online.`,
+	"JOIN": `JOIN <#room>[,<#room> ...] [<key>[,<key> ...]]
+Joins the rooms, creating them if they do not exist.`,
+	"KICK": `KICK <#room> <nickname> [:<reason>]
+Removes the user from the room. Requires operator status.`,
+	"LIST": `LIST [<filter>[,<filter> ...]]
+Lists the rooms. Filters are room names, masks with * and ?
+wildcards, !mask negated masks, >N and <N members count, C<N and
+C>N creation and T<N and T>N topic change time in minutes.`,
+	"LUSERS": `LUSERS
+Shows the number of connected users.`,
+	"MODE": `MODE <#room|nickname> [<modes> [<arguments>]]
+Shows or changes the room's or your own modes.`,
+	"MONITOR": `MONITOR <+|-|C|L|S> [<nickname>[,<nickname> ...]]
+Adds, removes, clears, lists and shows status of the nicknames
+you are notified about going online and offline.`,
+	"MOTD": `MOTD
+Shows the message of the day.`,
+	"NAMES": `NAMES [<#room>[,<#room> ...]]
+Lists the rooms' members.`,
+	"NICK": `NICK <nickname>
+Changes your nickname.`,
+	"NOTICE": `NOTICE <#room|nickname> :<message>
+Sends the notice. No automatic replies are sent to them.`,
+	"PART": `PART <#room>[,<#room> ...] [:<message>]
+Leaves the rooms.`,
+	"PASS": `PASS <password>
+Sets the connection password before registration.`,
+	"PING": `PING <token>
+Checks the connection. Server answers with PONG.`,
+	"PRIVMSG": `PRIVMSG <#room|nickname> :<message>
+Sends the message.`,
+	"QUIT": `QUIT [:<message>]
+Disconnects from the server.`,
+	"TAGMSG": `TAGMSG <#room|nickname>
+Sends only the message's tags. Requires message-tags capability.`,
+	"TIME": `TIME
+Shows the server's local time.`,
+	"TOPIC": `TOPIC <#room> [:<topic>]
+Shows or changes the room's topic.`,
+	"USER": `USER <username> <mode> <unused> :<realname>
+Sets your username and real name during registration.`,
+	"USERHOST": `USERHOST <nickname> [<nickname> ...]
+Shows the users' hosts, up to 5 of them.`,
+	"USERIP": `USERIP <nickname> [<nickname> ...]
+Shows the users' IP addresses, up to 5 of them.`,
+	"VERSION": `VERSION
+Shows the server's version and supported features.`,
+	"WHO": `WHO <#room|mask> [o][%<fields>[,<token>]]
+Lists the room's members or users matching the mask. o shows
+only channel operators: of that room, or of any visible room for
+the mask. % requests WHOX fields.`,
+	"WHOIS": `WHOIS <nickname>[,<nickname> ...]
+Shows information about the users.`,
+	"WHOWAS": `WHOWAS <nickname>[,<nickname> ...] [<count>]
+Shows information about the users who have left or changed
+their nicknames.`,
+}
+
+// Send help on the subject with 704, 705 and 706 replies, or the list
+// of commands having help if subject is empty. Unknown subjects get
+// 524 reply.
+func SendHelp(client *Client, subject string) {
+	var lines []string
+	if subject == "" {
+		subject = "*"
+		commands := make([]string, 0, len(HelpTexts))
+		for command := range HelpTexts {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		lines = []string{"Available commands, use HELP <command> for details:"}
+		for len(commands) > 0 {
+			n := min(8, len(commands))
+			lines = append(lines, strings.Join(commands[:n], " "))
+			commands = commands[n:]
+		}
+	} else {
+		text, found := HelpTexts[strings.ToUpper(subject)]
+		if !found {
+			client.ReplyNicknamed("524", subject, "No help available on this topic")
+			return
+		}
+		lines = strings.Split(text, "\n")
+	}
+	client.ReplyNicknamed("704", subject, lines[0])
+	for _, line := range lines[1:] {
+		client.ReplyNicknamed("705", subject, line)
+	}
+	client.ReplyNicknamed("706", subject, "End of /HELP")
+}
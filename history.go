@@ -0,0 +1,348 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximal number of messages kept in memory for each room
+	HistoryRoomSize = 10000
+	// Maximal number of messages sent in single CHATHISTORY reply
+	HistoryLimit = 100
+)
+
+// Room's message kept for playback with the command it was sent with
+type HistoryEntry struct {
+	msgid   string
+	when    time.Time
+	who     string
+	what    string
+	command string
+}
+
+// Room's messages ordered by time and indexed by msgid
+type History struct {
+	entries []*HistoryEntry
+	ids     map[string]*HistoryEntry
+}
+
+var (
+	histories  map[string]*History = make(map[string]*History)
+	historiesM sync.RWMutex
+)
+
+func init() {
+	CapRegister(&Capability{name: "draft/chathistory"})
+}
+
+// Remember room's message. Oldest ones are forgotten when room's
+// history size is exceeded.
+func HistoryAdd(where string, entry *HistoryEntry) {
+	historiesM.Lock()
+	history, found := histories[where]
+	if !found {
+		history = &History{ids: make(map[string]*HistoryEntry)}
+		histories[where] = history
+	}
+	history.entries = append(history.entries, entry)
+	history.ids[entry.msgid] = entry
+	if len(history.entries) > HistoryRoomSize {
+		for _, e := range history.entries[:len(history.entries)-HistoryRoomSize] {
+			delete(history.ids, e.msgid)
+		}
+		history.entries = append(
+			[]*HistoryEntry{},
+			history.entries[len(history.entries)-HistoryRoomSize:]...,
+		)
+	}
+	historiesM.Unlock()
+}
+
+// History keeper remembers messages from log events and passes all
+// of them further to the logger.
+func HistoryKeeper(events <-chan LogEvent, next chan<- LogEvent) {
+	for event := range events {
+		if !event.meta {
+			HistoryAdd(event.where, &HistoryEntry{
+				event.msgid,
+				event.when,
+				event.who,
+				event.what,
+				event.command,
+			})
+		}
+		if next != nil {
+			next <- event
+		}
+	}
+}
+
+// Load rooms messages history from log files written by Logger.
+// Lines of meta events and lines in older formats without msgid are
+// skipped.
+func HistoryLoad(logdir string) {
+	logs, err := filepath.Glob(path.Join(logdir, "#*.log"))
+	if err != nil {
+		log.Println("Can not read logdir", err)
+		return
+	}
+	for _, logfile := range logs {
+		fd, err := os.Open(logfile)
+		if err != nil {
+			log.Println("Can not open logfile", logfile, err)
+			continue
+		}
+		where := strings.TrimSuffix(path.Base(logfile), ".log")
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			if entry := HistoryParse(scanner.Text()); entry != nil {
+				HistoryAdd(where, entry)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			log.Println("Error reading logfile", logfile, err)
+		}
+		fd.Close()
+	}
+}
+
+// Parse message line of log file. Notices are written with -who- instead
+// of <who>.
+func HistoryParse(line string) *HistoryEntry {
+	if !strings.HasPrefix(line, "[") {
+		return nil
+	}
+	i := strings.Index(line, "] ")
+	if i == -1 {
+		return nil
+	}
+	when, err := time.Parse(time.RFC3339Nano, line[1:i])
+	if err != nil {
+		return nil
+	}
+	cols := strings.SplitN(line[i+2:], " ", 3)
+	if len(cols) != 3 || cols[0] == "" || len(cols[1]) < 3 {
+		return nil
+	}
+	var command string
+	switch cols[1][0:1] + cols[1][len(cols[1])-1:] {
+	case "<>":
+		command = "PRIVMSG"
+	case "--":
+		command = "NOTICE"
+	default:
+		return nil
+	}
+	return &HistoryEntry{cols[0], when, cols[1][1 : len(cols[1])-1], cols[2], command}
+}
+
+// Find position of the message with specified msgid.
+func (history *History) index(msgid string) int {
+	entry, found := history.ids[msgid]
+	if !found {
+		return -1
+	}
+	i := sort.Search(len(history.entries), func(i int) bool {
+		return !history.entries[i].when.Before(entry.when)
+	})
+	for ; i < len(history.entries); i++ {
+		if history.entries[i] == entry {
+			return i
+		}
+	}
+	return -1
+}
+
+// Resolve "msgid=" or "timestamp=" message reference to the positions
+// of the first message not older than it and the first message newer
+// than it.
+func (history *History) bounds(ref string) (int, int, bool) {
+	cols := strings.SplitN(ref, "=", 2)
+	if len(cols) != 2 {
+		return 0, 0, false
+	}
+	switch cols[0] {
+	case "msgid":
+		i := history.index(cols[1])
+		return i, i + 1, i != -1
+	case "timestamp":
+		when, err := time.Parse(time.RFC3339Nano, cols[1])
+		if err != nil {
+			return 0, 0, false
+		}
+		lo := sort.Search(len(history.entries), func(i int) bool {
+			return !history.entries[i].when.Before(when)
+		})
+		hi := sort.Search(len(history.entries), func(i int) bool {
+			return history.entries[i].when.After(when)
+		})
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
+
+// Select messages from room's history using CHATHISTORY subcommand
+// and its references.
+func HistorySelect(where, subcmd string, refs []string, limit int) ([]*HistoryEntry, bool) {
+	historiesM.RLock()
+	defer historiesM.RUnlock()
+	history, found := histories[where]
+	if !found {
+		history = &History{}
+	}
+	entries := history.entries
+	var start, end int
+	switch subcmd {
+	case "LATEST":
+		start, end = max(0, len(entries)-limit), len(entries)
+		if refs[0] != "*" {
+			_, hi, ok := history.bounds(refs[0])
+			if !ok {
+				return nil, false
+			}
+			start = max(start, hi)
+		}
+	case "BEFORE":
+		lo, _, ok := history.bounds(refs[0])
+		if !ok {
+			return nil, false
+		}
+		start, end = max(0, lo-limit), lo
+	case "AFTER":
+		_, hi, ok := history.bounds(refs[0])
+		if !ok {
+			return nil, false
+		}
+		start, end = hi, min(len(entries), hi+limit)
+	case "AROUND":
+		lo, _, ok := history.bounds(refs[0])
+		if !ok {
+			return nil, false
+		}
+		start = max(0, lo-limit/2)
+		end = min(len(entries), start+limit)
+	case "BETWEEN":
+		lo1, hi1, ok1 := history.bounds(refs[0])
+		lo2, hi2, ok2 := history.bounds(refs[1])
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		if lo1 <= lo2 {
+			start, end = hi1, min(lo2, hi1+limit)
+		} else {
+			start, end = max(hi2, lo1-limit), lo1
+		}
+	default:
+		return nil, false
+	}
+	if start >= end {
+		return nil, true
+	}
+	return append([]*HistoryEntry{}, entries[start:end]...), true
+}
+
+// Handle CHATHISTORY command. Only members can request room's history.
+func HandlerChatHistory(client *Client, msg *Message) {
+	subcmd := strings.ToUpper(msg.Param(0))
+	refsNum := 1
+	switch subcmd {
+	case "LATEST", "BEFORE", "AFTER", "AROUND":
+	case "BETWEEN":
+		refsNum = 2
+	case "":
+		client.ReplyNotEnoughParameters("CHATHISTORY")
+		return
+	default:
+		client.Reply(fmt.Sprintf(
+			"FAIL CHATHISTORY INVALID_PARAMS %s :Unknown subcommand", subcmd,
+		))
+		return
+	}
+	if len(msg.params) < 3+refsNum {
+		client.Reply(fmt.Sprintf(
+			"FAIL CHATHISTORY NEED_MORE_PARAMS %s :Missing parameters", subcmd,
+		))
+		return
+	}
+	target := msg.params[1]
+	limit, err := strconv.Atoi(msg.params[2+refsNum])
+	if err != nil || limit <= 0 {
+		client.Reply(fmt.Sprintf(
+			"FAIL CHATHISTORY INVALID_PARAMS %s :Invalid limit", subcmd,
+		))
+		return
+	}
+	if limit > HistoryLimit {
+		limit = HistoryLimit
+	}
+	subscribed := false
+	roomsM.RLock()
+	if r, found := rooms[RoomKey(target)]; found {
+		r.RLock()
+		_, subscribed = r.members[client]
+		target = *r.name
+		r.RUnlock()
+	}
+	roomsM.RUnlock()
+	if !subscribed {
+		client.Reply(fmt.Sprintf(
+			"FAIL CHATHISTORY INVALID_TARGET %s %s :Messages could not be retrieved",
+			subcmd, target,
+		))
+		return
+	}
+	entries, ok := HistorySelect(target, subcmd, msg.params[2:2+refsNum], limit)
+	if !ok {
+		client.Reply(fmt.Sprintf(
+			"FAIL CHATHISTORY INVALID_PARAMS %s :Invalid message reference", subcmd,
+		))
+		return
+	}
+	HistorySend(client, target, entries)
+}
+
+// Send history messages inside the batch.
+func HistorySend(client *Client, target string, entries []*HistoryEntry) {
+	ref := client.BatchStart("chathistory", target)
+	for _, entry := range entries {
+		relay := NewMessage(entry.who, entry.command, target, entry.what)
+		relay.trailing = true
+		relay.tags = map[string]string{
+			"time":  entry.when.UTC().Format(TimeFormat),
+			"msgid": entry.msgid,
+		}
+		if ref != "" {
+			relay.tags["batch"] = ref
+		}
+		client.MsgTagged(relay)
+	}
+	client.BatchEnd(ref)
+}
@@ -0,0 +1,304 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryParse(t *testing.T) {
+	entry := HistoryParse("[2017-01-02T15:04:05.123456789Z] abc <nick> hello world")
+	if entry == nil || entry.msgid != "abc" || entry.who != "nick" ||
+		entry.what != "hello world" || entry.when.Nanosecond() != 123456789 ||
+		entry.command != "PRIVMSG" {
+		t.Fatal("message line", entry)
+	}
+	entry = HistoryParse("[2017-01-02T15:04:05Z] abc -nick- hello world")
+	if entry == nil || entry.who != "nick" || entry.command != "NOTICE" {
+		t.Fatal("notice line", entry)
+	}
+	for _, line := range []string{
+		"[2017-01-02T15:04:05Z] abc * nick joined",
+		"[2017-01-02 15:04:05.1 +0000 UTC] <nick> hello",
+		"garbage",
+	} {
+		if entry = HistoryParse(line); entry != nil {
+			t.Fatal("non-message line", line, entry)
+		}
+	}
+}
+
+func TestHistorySelect(t *testing.T) {
+	histories = make(map[string]*History)
+	when := time.Date(2017, 1, 2, 15, 4, 0, 0, time.UTC)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		HistoryAdd("#foo", &HistoryEntry{id, when, "nick", "text " + id, "PRIVMSG"})
+		when = when.Add(time.Second)
+	}
+	ids := func(entries []*HistoryEntry) string {
+		r := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			r = append(r, entry.msgid)
+		}
+		return strings.Join(r, "")
+	}
+	for _, c := range []struct {
+		subcmd string
+		refs   []string
+		limit  int
+		want   string
+	}{
+		{"LATEST", []string{"*"}, 2, "de"},
+		{"LATEST", []string{"msgid=b"}, 10, "cde"},
+		{"BEFORE", []string{"msgid=d"}, 2, "bc"},
+		{"BEFORE", []string{"timestamp=2017-01-02T15:04:01.500Z"}, 10, "ab"},
+		{"AFTER", []string{"msgid=b"}, 2, "cd"},
+		{"AFTER", []string{"timestamp=2017-01-02T15:04:01Z"}, 10, "cde"},
+		{"AROUND", []string{"msgid=c"}, 3, "bcd"},
+		{"BETWEEN", []string{"msgid=a", "msgid=e"}, 2, "bc"},
+		{"BETWEEN", []string{"msgid=e", "msgid=a"}, 2, "cd"},
+	} {
+		entries, ok := HistorySelect("#foo", c.subcmd, c.refs, c.limit)
+		if got := ids(entries); !ok || got != c.want {
+			t.Fatal(c.subcmd, c.refs, got)
+		}
+	}
+	if _, ok := HistorySelect("#foo", "BEFORE", []string{"msgid=z"}, 10); ok {
+		t.Fatal("unknown msgid")
+	}
+	if entries, ok := HistorySelect("#bar", "LATEST", []string{"*"}, 10); !ok || len(entries) != 0 {
+		t.Fatal("unknown room", entries)
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	histories = make(map[string]*History)
+	logSink = make(chan LogEvent)
+	logged := make(chan LogEvent, 8)
+	go HistoryKeeper(logSink, logged)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+		close(logSink)
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "CAP LS 302"
+	<-conn1.outbound
+	conn1.inbound <- "CAP REQ :batch server-time"
+	<-conn1.outbound
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "CHATHISTORY LATEST #foo * 10"
+	if r := <-conn1.outbound; r != ":foohost FAIL CHATHISTORY INVALID_TARGET LATEST #foo :Messages could not be retrieved\r\n" {
+		t.Fatal("non-member", r)
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-logged
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	<-logged
+	for _, text := range []string{"PRIVMSG #foo :one", "PRIVMSG #foo :two", "NOTICE #foo :three"} {
+		conn2.inbound <- text
+		<-conn1.outbound
+		<-logged
+	}
+
+	conn1.inbound <- "CHATHISTORY FOO #foo * 10"
+	if r := <-conn1.outbound; r != ":foohost FAIL CHATHISTORY INVALID_PARAMS FOO :Unknown subcommand\r\n" {
+		t.Fatal("unknown subcommand", r)
+	}
+	conn1.inbound <- "CHATHISTORY LATEST #foo *"
+	if r := <-conn1.outbound; r != ":foohost FAIL CHATHISTORY NEED_MORE_PARAMS LATEST :Missing parameters\r\n" {
+		t.Fatal("no limit", r)
+	}
+	conn1.inbound <- "CHATHISTORY LATEST #foo * 2"
+	r := <-conn1.outbound
+	if !strings.HasPrefix(r, ":foohost BATCH +") || !strings.HasSuffix(r, " chathistory #foo\r\n") {
+		t.Fatal("batch start", r)
+	}
+	ref := strings.Fields(r)[2][1:]
+	for _, text := range []string{"PRIVMSG #foo :two", "NOTICE #foo :three"} {
+		r = <-conn1.outbound
+		msg, err := ParseMessage(strings.TrimSuffix(r, "\r\n"))
+		if err != nil || msg.tags["batch"] != ref || msg.tags["time"] == "" ||
+			!strings.HasSuffix(r, " :nick2 "+text+"\r\n") {
+			t.Fatal("history message", r)
+		}
+	}
+	if r = <-conn1.outbound; r != ":foohost BATCH -"+ref+"\r\n" {
+		t.Fatal("batch end", r)
+	}
+
+	conn2.inbound <- "CHATHISTORY BEFORE #foo msgid=unknown 2"
+	if r = <-conn2.outbound; r != ":foohost FAIL CHATHISTORY INVALID_PARAMS BEFORE :Invalid message reference\r\n" {
+		t.Fatal("unknown msgid", r)
+	}
+	conn2.inbound <- "CHATHISTORY AFTER #foo timestamp=2000-01-01T00:00:00.000Z 1"
+	if r = <-conn2.outbound; r != ":nick2 PRIVMSG #foo :one\r\n" {
+		t.Fatal("history without capabilities", r)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	histories = make(map[string]*History)
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+	when := time.Now().Add(-2 * time.Hour)
+	HistoryAdd("#foo", &HistoryEntry{"a", when, "nick3", "old", "PRIVMSG"})
+	for _, id := range []string{"b", "c", "d"} {
+		HistoryAdd("#foo", &HistoryEntry{id, time.Now(), "nick3", "text " + id, "PRIVMSG"})
+	}
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "CAP LS 302"
+	<-conn2.outbound
+	conn2.inbound <- "CAP REQ :batch server-time"
+	<-conn2.outbound
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\nCAP END"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "MODE #foo +H 5:1h"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +H 5:3600\r\n" {
+		t.Fatal("replay mode", r)
+	}
+	if r := <-stateSink; r.modes != "+ntH 5:3600" {
+		t.Fatal("replay mode state", r)
+	}
+	conn1.inbound <- "PART #foo"
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		r := <-conn1.outbound
+		if !strings.HasPrefix(r, ":foohost NOTICE #foo :[") ||
+			!strings.HasSuffix(r, "] <nick3> text "+id+"\r\n") {
+			t.Fatal("replayed notice", r)
+		}
+	}
+
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	if r := <-conn2.outbound; !strings.HasPrefix(r, ":foohost BATCH +") {
+		t.Fatal("replay batch", r)
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		r := <-conn2.outbound
+		if !strings.HasPrefix(r, "@batch=") || !strings.Contains(r, ";time=") ||
+			!strings.HasSuffix(r, " :nick3 PRIVMSG #foo :text "+id+"\r\n") {
+			t.Fatal("replayed message", r)
+		}
+	}
+	if r := <-conn2.outbound; !strings.HasPrefix(r, ":foohost BATCH -") {
+		t.Fatal("replay batch end", r)
+	}
+
+	room := NewRoom("#bar")
+	room.StateRestore([]string{"topic", "", "+ntlH 10 2:60"})
+	if room.limit != 10 || room.history != 2 || room.window != time.Minute {
+		t.Fatal("replay state restore", room.limit, room.history, room.window)
+	}
+	room = NewRoom("#baz")
+	room.StateRestore([]string{"topic", "", "+ntH 0:3600"})
+	if room.history != 0 || room.window != time.Hour || room.Modes(false) != "+ntH 0:3600" {
+		t.Fatal("window only replay state restore", room.Modes(false))
+	}
+}
+
+func TestReplayParse(t *testing.T) {
+	for arg, want := range map[string]string{
+		"5":      "5",
+		"5:1h":   "5:3600",
+		"500:60": "100:60",
+		"0:3600": "0:3600",
+		"0:1h":   "0:3600",
+		"0":      "",
+		"0:0":    "",
+		"-1:60":  "",
+		"5:-60":  "",
+		"5:foo":  "",
+		"foo":    "",
+	} {
+		count, window, ok := ReplayParse(arg)
+		if (want == "") == ok || (ok && ReplayString(count, window) != want) {
+			t.Fatal(arg, count, window, ok)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximal number of nicknames in single USERHOST/USERIP request
+	UserhostLimit = 5
+)
+
+// Send 302 (USERHOST) or 340 (USERIP if ip is set) reply with
+// nick=+user@host entries of the existing clients. "-" is used instead
+// of "+" for away ones.
+func SendUserhost(client *Client, nicknames []string, ip bool) {
+	if len(nicknames) > UserhostLimit {
+		nicknames = nicknames[:UserhostLimit]
+	}
+	replies := make([]string, 0, len(nicknames))
+	clientsM.RLock()
+	for _, nickname := range nicknames {
+		nickname = strings.ToLower(nickname)
+		for c := range clients {
+			if !c.registered || strings.ToLower(*c.nickname) != nickname {
+				continue
+			}
+			away := "+"
+			if c.away != nil {
+				away = "-"
+			}
+			host := c.Host()
+			if ip {
+				if addr, _, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+					host = addr
+				}
+			}
+			replies = append(replies, *c.nickname+"="+away+*c.username+"@"+host)
+			break
+		}
+	}
+	clientsM.RUnlock()
+	code := "302"
+	if ip {
+		code = "340"
+	}
+	client.ReplyNicknamed(code, strings.Join(replies, " "))
+}
+
+// Send 391 reply with server's local time.
+func SendTime(client *Client) {
+	client.ReplyNicknamed("391", *hostname, time.Now().Format(time.RFC1123))
+}
+
+// Send INFO replies with the build information.
+func SendInfo(client *Client) {
+	for _, line := range []string{
+		"goircd " + version,
+		"minimalistic simple Internet Relay Chat (IRC) server",
+		"Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>",
+		"Licensed under GNU GPLv3 or later",
+		"Built with " + runtime.Version() + " for " + runtime.GOOS + "/" + runtime.GOARCH,
+	} {
+		client.ReplyNicknamed("371", line)
+	}
+	client.ReplyNicknamed("374", "End of /INFO list")
+}
+
+// Send ADMIN replies with administrative information from the
+// configuration, or 423 if there is none.
+func SendAdmin(client *Client) {
+	if *adminLoc1 == "" && *adminLoc2 == "" && *adminEmail == "" {
+		client.ReplyNicknamed("423", *hostname, "No administrative info available")
+		return
+	}
+	client.ReplyNicknamed("256", *hostname, "Administrative info")
+	client.ReplyNicknamed("257", *adminLoc1)
+	client.ReplyNicknamed("258", *adminLoc2)
+	client.ReplyNicknamed("259", *adminEmail)
+}
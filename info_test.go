@@ -0,0 +1,148 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInfoCommands(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn2.inbound <- "AWAY :gone"
+	<-conn2.outbound
+
+	conn1.inbound <- "USERHOST"
+	if r := <-conn1.outbound; r != ":foohost 461 nick1 USERHOST :Not enough parameters\r\n" {
+		t.Fatal("USERHOST without nicknames", r)
+	}
+	conn1.inbound <- "USERHOST NICK1 nick2 nick3"
+	if r := <-conn1.outbound; r != ":foohost 302 nick1 :nick1=+foo1@someclient nick2=-foo2@someclient\r\n" {
+		t.Fatal("USERHOST", r)
+	}
+	conn1.inbound <- "USERIP nick3"
+	if r := <-conn1.outbound; r != ":foohost 340 nick1 :\r\n" {
+		t.Fatal("USERIP unknown", r)
+	}
+	conn1.inbound <- "TIME"
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 391 nick1 foohost :") {
+		t.Fatal("TIME", r)
+	}
+	conn1.inbound <- "VERSION"
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 351 nick1 ") {
+		t.Fatal("VERSION", r)
+	}
+	for i := 0; i < 2; i++ {
+		if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 005 nick1 ") {
+			t.Fatal("VERSION ISUPPORT", r)
+		}
+	}
+	conn1.inbound <- "INFO"
+	if r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 371 nick1 :goircd ") {
+		t.Fatal("INFO", r)
+	}
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	if r := <-conn1.outbound; r != ":foohost 374 nick1 :End of /INFO list\r\n" {
+		t.Fatal("INFO end", r)
+	}
+
+	conn1.inbound <- "ADMIN"
+	if r := <-conn1.outbound; r != ":foohost 423 nick1 foohost :No administrative info available\r\n" {
+		t.Fatal("ADMIN without configuration", r)
+	}
+	loc1, loc2, email := "Moscow", "Home", "admin@example.com"
+	adminLoc1, adminLoc2, adminEmail = &loc1, &loc2, &email
+	defer func() {
+		loc1, loc2, email = "", "", ""
+	}()
+	conn1.inbound <- "ADMIN"
+	for _, want := range []string{
+		":foohost 256 nick1 foohost :Administrative info\r\n",
+		":foohost 257 nick1 :Moscow\r\n",
+		":foohost 258 nick1 :Home\r\n",
+		":foohost 259 nick1 :admin@example.com\r\n",
+	} {
+		if r := <-conn1.outbound; r != want {
+			t.Fatal("ADMIN", r)
+		}
+	}
+
+	conn1.inbound <- "HELP"
+	if r := <-conn1.outbound; r != ":foohost 704 nick1 * :Available commands, use HELP <command> for details:\r\n" {
+		t.Fatal("HELP index", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 705 nick1 * :ADMIN AUTHENTICATE AWAY CAP CHATHISTORY HELP INFO INVITE\r\n" {
+		t.Fatal("HELP index commands", r)
+	}
+	for r := <-conn1.outbound; !strings.HasPrefix(r, ":foohost 706 "); r = <-conn1.outbound {
+	}
+	conn1.inbound <- "HELPOP time"
+	if r := <-conn1.outbound; r != ":foohost 704 nick1 time :TIME\r\n" {
+		t.Fatal("HELP subject", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 705 nick1 time :Shows the server's local time.\r\n" {
+		t.Fatal("HELP text", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 706 nick1 time :End of /HELP\r\n" {
+		t.Fatal("HELP end", r)
+	}
+	conn1.inbound <- "HELP foo"
+	if r := <-conn1.outbound; r != ":foohost 524 nick1 foo :No help available on this topic\r\n" {
+		t.Fatal("HELP unknown", r)
+	}
+}
+
+func TestHelpTexts(t *testing.T) {
+	for command, text := range HelpTexts {
+		if !strings.HasPrefix(text, command) || !strings.Contains(text, "\n") {
+			t.Fatal("malformed help text", command)
+		}
+	}
+}
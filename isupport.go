@@ -0,0 +1,92 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Supported user modes
+	UserModes = "i"
+	// Maximal topic's length, longer ones are truncated
+	TopicLen = 390
+	// Maximal number of ISUPPORT tokens in single 005 reply
+	ISupportTokens = 13
+)
+
+// Channel modes letters: all of them and only ones having parameters.
+func ChanModes() (string, string) {
+	all := []byte(RoomFlags + "beHIklov")
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return string(all), "beHIklov"
+}
+
+// ISUPPORT tokens describing server's features and limits.
+func ISupport() []string {
+	return []string{
+		"CASEMAPPING=ascii",
+		"CHANMODES=beI,k,Hl," + RoomFlags,
+		"CHANNELLEN=201",
+		"CHANTYPES=#",
+		"CHATHISTORY=" + strconv.Itoa(HistoryLimit),
+		"ELIST=CMNTU",
+		"EXCEPTS=e",
+		"INVEX=I",
+		"MODES",
+		"MONITOR=" + strconv.Itoa(*monLimit),
+		"MSGREFTYPES=msgid,timestamp",
+		"NETWORK=" + *hostname,
+		"NICKLEN=24",
+		"PREFIX=(ov)@+",
+		"TARGMAX=JOIN:,LIST:,NAMES:,NOTICE:1,PART:,PRIVMSG:1,TAGMSG:1,WHOIS:",
+		"TOPICLEN=" + strconv.Itoa(TopicLen),
+		"WHOX",
+	}
+}
+
+// Send 004 reply describing the server. It is sent only once during
+// the registration.
+func SendMyInfo(client *Client) {
+	chanModes, chanModesParams := ChanModes()
+	client.Reply(strings.Join([]string{
+		"004",
+		*client.nickname,
+		*hostname,
+		"goircd-" + version,
+		UserModes,
+		chanModes,
+		chanModesParams,
+	}, " "))
+}
+
+// Send 005 replies with ISUPPORT tokens.
+func SendISupport(client *Client) {
+	tokens := ISupport()
+	for len(tokens) > 0 {
+		n := ISupportTokens
+		if n > len(tokens) {
+			n = len(tokens)
+		}
+		client.ReplyNicknamed("005", append(tokens[:n:n], "are supported by this server")...)
+		tokens = tokens[n:]
+	}
+}
@@ -0,0 +1,84 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+func init() {
+	CapRegister(&Capability{name: "labeled-response"})
+}
+
+// Start collecting messages sent to the client as the response to the
+// labeled command.
+func (c *Client) LabelStart(label string) {
+	c.Lock()
+	c.label = &label
+	c.labelBuf = nil
+	c.Unlock()
+}
+
+// Send collected response tagged with the label: empty one is
+// acknowledged with ACK, single message is tagged itself and several
+// ones are wrapped in the labeled-response batch.
+func (c *Client) LabelFinish() {
+	c.Lock()
+	label := *c.label
+	lines := c.labelBuf
+	c.label = nil
+	c.labelBuf = nil
+	c.Unlock()
+	switch {
+	case len(lines) == 0:
+		ack := NewMessage(*hostname, "ACK")
+		ack.tags = map[string]string{"label": label}
+		c.Msg(ack.String())
+		return
+	case len(lines) == 1:
+		if msg, err := ParseMessage(lines[0]); err == nil {
+			if msg.tags == nil {
+				msg.tags = make(map[string]string)
+			}
+			msg.tags["label"] = label
+			c.Msg(msg.String())
+			return
+		}
+	case c.CapEnabled("batch"):
+		ref := NewMsgID()
+		start := NewMessage(*hostname, "BATCH", "+"+ref, "labeled-response")
+		start.tags = map[string]string{"label": label}
+		c.Msg(start.String())
+		for _, line := range lines {
+			msg, err := ParseMessage(line)
+			if err != nil {
+				continue
+			}
+			// Nested batches messages keep their own reference
+			if _, found := msg.tags["batch"]; !found {
+				if msg.tags == nil {
+					msg.tags = make(map[string]string)
+				}
+				msg.tags["batch"] = ref
+			}
+			c.Msg(msg.String())
+		}
+		c.BatchEnd(ref)
+		return
+	}
+	for _, line := range lines {
+		c.Msg(line)
+	}
+}
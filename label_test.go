@@ -0,0 +1,198 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabeledResponse(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+	conn.inbound <- "CAP LS 302"
+	<-conn.outbound
+	conn.inbound <- "CAP REQ :batch labeled-response message-tags"
+	<-conn.outbound
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	for i := 0; i < 8; i++ {
+		<-conn.outbound
+	}
+
+	conn.inbound <- "@label=a PING :foo"
+	if r := <-conn.outbound; r != "@label=a :foohost PONG foohost :foo\r\n" {
+		t.Fatal("single line response", r)
+	}
+	conn.inbound <- "@label=b PONG :foo"
+	if r := <-conn.outbound; r != "@label=b :foohost ACK\r\n" {
+		t.Fatal("empty response", r)
+	}
+	conn.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "@label=c WHO #foo"
+	r := <-conn.outbound
+	if !strings.HasPrefix(r, "@label=c :foohost BATCH +") || !strings.HasSuffix(r, " labeled-response\r\n") {
+		t.Fatal("batch start", r)
+	}
+	ref := strings.Fields(r)[3][1:]
+	if r = <-conn.outbound; r != "@batch="+ref+" :foohost 352 nick1 #foo foo1 someclient foohost nick1 H@ :0 Long name1\r\n" {
+		t.Fatal("batched WHO reply", r)
+	}
+	if r = <-conn.outbound; r != "@batch="+ref+" :foohost 315 nick1 #foo :End of /WHO list\r\n" {
+		t.Fatal("batched WHO end", r)
+	}
+	if r = <-conn.outbound; r != ":foohost BATCH -"+ref+"\r\n" {
+		t.Fatal("batch end", r)
+	}
+	conn.inbound <- "@label=d LIST"
+	if r = <-conn.outbound; !strings.HasPrefix(r, "@label=d :foohost BATCH +") {
+		t.Fatal("batch start", r)
+	}
+	for r = <-conn.outbound; !strings.HasPrefix(r, ":foohost BATCH -"); r = <-conn.outbound {
+	}
+
+	// Replies to the previous unlabeled command are not in the response
+	conn.inbound <- "JOIN #bar\r\n@label=e PING :foo"
+	for _, code := range []string{"331", "JOIN", "353", "366"} {
+		if r = <-conn.outbound; strings.Contains(r, "label=") || !strings.Contains(r, " "+code+" ") {
+			t.Fatal("unlabeled JOIN before labeled command", r)
+		}
+	}
+	if r = <-conn.outbound; r != "@label=e :foohost PONG foohost :foo\r\n" {
+		t.Fatal("labeled command after unlabeled JOIN", r)
+	}
+
+	// Room emptied and removed before the sync is skipped
+	roomsM.RLock()
+	room := rooms["#bar"]
+	roomsM.RUnlock()
+	conn.inbound <- "PART #bar"
+	for {
+		room.RLock()
+		n := len(room.members)
+		room.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	events <- ClientEvent{eventType: EventTick}
+	conn.inbound <- "@label=f PING :foo"
+	if r = <-conn.outbound; r != "@label=f :foohost PONG foohost :foo\r\n" {
+		t.Fatal("labeled command after room removal", r)
+	}
+}
+
+func TestLabeledNotifications(t *testing.T) {
+	host := "foohost"
+	hostname = &host
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	client.LabelStart("a")
+	client.Notify(":nick2!foo2@someclient PRIVMSG nick1 :unrelated")
+	if r := <-conn.outbound; r != ":nick2!foo2@someclient PRIVMSG nick1 :unrelated\r\n" {
+		t.Fatal("notification during labeled response", r)
+	}
+	client.Msg(":foohost PONG foohost :foo")
+	client.LabelFinish()
+	if r := <-conn.outbound; r != "@label=a :foohost PONG foohost :foo\r\n" {
+		t.Fatal("labeled response after notification", r)
+	}
+}
+
+func TestLabeledConcurrent(t *testing.T) {
+	logSink = make(chan LogEvent, 32)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "CAP LS 302"
+	<-conn1.outbound
+	conn1.inbound <- "CAP REQ :batch labeled-response"
+	<-conn1.outbound
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	for i := 0; i < 20; i++ {
+		go func() { conn2.inbound <- "PRIVMSG #foo :unrelated" }()
+		conn1.inbound <- "@label=a TOPIC #foo"
+		replies := []string{<-conn1.outbound, <-conn1.outbound}
+		if replies[0] == ":nick2!foo2@someclient PRIVMSG #foo :unrelated\r\n" {
+			replies[0], replies[1] = replies[1], replies[0]
+		}
+		if replies[0] != "@label=a :foohost 331 nick1 #foo :No topic is set\r\n" ||
+			replies[1] != ":nick2!foo2@someclient PRIVMSG #foo :unrelated\r\n" {
+			t.Fatal("unrelated message in labeled response", replies)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LIST filters: room name masks, negated ones and ELIST conditions on
+// members count, creation and topic set time. Zero values mean no
+// condition.
+type ListFilter struct {
+	masks         []string
+	negated       []string
+	usersMore     int
+	usersLess     int
+	createdAfter  time.Time
+	createdBefore time.Time
+	topicAfter    time.Time
+	topicBefore   time.Time
+}
+
+// Parse comma separated LIST parameter consisting of room names, masks
+// with "*" and "?" wildcards, "!mask" negated masks and ELIST
+// conditions: ">N" and "<N" members, "C<N" and "C>N" minutes since
+// creation, "T<N" and "T>N" minutes since topic change. Malformed
+// conditions are ignored.
+func ListFilterParse(s string, now time.Time) *ListFilter {
+	filter := ListFilter{}
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+		var kind byte
+		if len(item) > 1 && (item[0] == 'C' || item[0] == 'T') &&
+			(item[1] == '<' || item[1] == '>') {
+			kind, item = item[0], item[1:]
+		}
+		if item[0] == '!' {
+			filter.negated = append(filter.negated, item[1:])
+			continue
+		}
+		if item[0] != '<' && item[0] != '>' {
+			filter.masks = append(filter.masks, item)
+			continue
+		}
+		n, err := strconv.Atoi(item[1:])
+		if err != nil || n < 0 {
+			continue
+		}
+		ago := now.Add(-time.Duration(n) * time.Minute)
+		switch {
+		case kind == 0 && item[0] == '>':
+			filter.usersMore = n + 1
+		case kind == 0:
+			filter.usersLess = n
+		case kind == 'C' && item[0] == '<':
+			filter.createdAfter = ago
+		case kind == 'C':
+			filter.createdBefore = ago
+		case kind == 'T' && item[0] == '<':
+			filter.topicAfter = ago
+		default:
+			filter.topicBefore = ago
+		}
+	}
+	return &filter
+}
+
+// Does room with given name, members count, creation and topic set
+// times satisfy the filter. Rooms whose topic was never set are
+// considered to have it infinitely old.
+func (f *ListFilter) Match(name string, users int, created, topicSet time.Time) bool {
+	if len(f.masks) > 0 {
+		found := false
+		for _, mask := range f.masks {
+			if MaskMatch(mask, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, mask := range f.negated {
+		if MaskMatch(mask, name) {
+			return false
+		}
+	}
+	if (f.usersMore > 0 && users < f.usersMore) ||
+		(f.usersLess > 0 && users >= f.usersLess) {
+		return false
+	}
+	if (!f.createdAfter.IsZero() && !created.After(f.createdAfter)) ||
+		(!f.createdBefore.IsZero() && !created.Before(f.createdBefore)) {
+		return false
+	}
+	if (!f.topicAfter.IsZero() && !topicSet.After(f.topicAfter)) ||
+		(!f.topicBefore.IsZero() && !topicSet.Before(f.topicBefore)) {
+		return false
+	}
+	return true
+}
+
+// Send LIST replies for the rooms satisfying the filter. Rooms list is
+// copied first, so roomsM is not held while replies are sent. Hidden
+// rooms are skipped.
+func SendList(client *Client, params []string) {
+	var filter *ListFilter
+	if len(params) > 0 {
+		filter = ListFilterParse(params[0], time.Now())
+	} else {
+		filter = &ListFilter{}
+	}
+	rs := make([]*Room, 0)
+	roomsM.RLock()
+	for _, room := range rooms {
+		rs = append(rs, room)
+	}
+	roomsM.RUnlock()
+	sort.Slice(rs, func(i, j int) bool { return rs[i].String() < rs[j].String() })
+	client.ReplyNicknamed("321", "Channel", "Users  Name")
+	for _, room := range rs {
+		if room.Hidden(client) {
+			continue
+		}
+		room.RLock()
+		name, users, topic := *room.name, len(room.members), *room.topic
+		matched := filter.Match(name, users, room.created, room.topicSet)
+		room.RUnlock()
+		if matched {
+			client.ReplyNicknamed("322", name, strconv.Itoa(users), topic)
+		}
+	}
+	client.ReplyNicknamed("323", "End of /LIST")
+}
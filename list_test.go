@@ -0,0 +1,123 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListFilter(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	for _, c := range []struct {
+		filter   string
+		name     string
+		users    int
+		created  time.Time
+		topicSet time.Time
+		matched  bool
+	}{
+		{"", "#foo", 1, now, now, true},
+		{"#foo,#bar", "#bar", 1, now, now, true},
+		{"#foo,#bar", "#baz", 1, now, now, false},
+		{"#FOO", "#foo", 1, now, now, true},
+		{"#f*", "#foo", 1, now, now, true},
+		{"#f*,!#fo?", "#foo", 1, now, now, false},
+		{"!#bar", "#foo", 1, now, now, true},
+		{">2", "#foo", 2, now, now, false},
+		{">2", "#foo", 3, now, now, true},
+		{"<2", "#foo", 2, now, now, false},
+		{"<2", "#foo", 1, now, now, true},
+		{">1,<3", "#foo", 2, now, now, true},
+		{">x", "#foo", 1, now, now, true},
+		{"C<30", "#foo", 1, now, now, true},
+		{"C<30", "#foo", 1, hourAgo, now, false},
+		{"C>30", "#foo", 1, hourAgo, now, true},
+		{"C>30", "#foo", 1, now, now, false},
+		{"T<30", "#foo", 1, now, now, true},
+		{"T<30", "#foo", 1, now, time.Time{}, false},
+		{"T>30", "#foo", 1, now, hourAgo, true},
+		{"T>30", "#foo", 1, now, time.Time{}, true},
+		{"T>30", "#foo", 1, now, now, false},
+	} {
+		if ListFilterParse(c.filter, now).Match(c.name, c.users, c.created, c.topicSet) != c.matched {
+			t.Fatal(c.filter, c.name, c.users)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 8; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "JOIN #foo,#bar,#baz"
+	for i := 0; i < 12; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "TOPIC #bar :new topic"
+	<-conn.outbound
+
+	conn.inbound <- "LIST #b*,!#baz"
+	if r := <-conn.outbound; r != ":foohost 321 nick1 Channel :Users  Name\r\n" {
+		t.Fatal("LIST start", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 322 nick1 #bar 1 :new topic\r\n" {
+		t.Fatal("LIST with masks", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
+		t.Fatal("LIST end", r)
+	}
+	conn.inbound <- "LIST T>5,<2"
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 322 nick1 #baz 1 :\r\n" {
+		t.Fatal("LIST with conditions first", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 322 nick1 #foo 1 :\r\n" {
+		t.Fatal("LIST with conditions second", r)
+	}
+	<-conn.outbound
+	conn.inbound <- "LIST >1"
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
+		t.Fatal("LIST with members count", r)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximal number of command's parameters
+	MaxParams = 15
+	// Format of IRCv3 server-time tag value
+	TimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	ErrEmptyMessage = errors.New("empty message")
+
+	// Tags that can be sent to clients without message-tags capability,
+	// but with their own one
+	TagCaps = map[string]string{"time": "server-time"}
+
+	tagEscapes   = strings.NewReplacer(";", "\\:", " ", "\\s", "\\", "\\\\", "\r", "\\r", "\n", "\\n")
+	tagUnescapes = map[byte]byte{':': ';', 's': ' ', '\\': '\\', 'r': '\r', 'n': '\n'}
+)
+
+// IRC message with optional IRCv3 tags and source, command and its
+// parameters. The last parameter is sent as a trailing one (prefixed
+// with ":") if trailing is true or if it is required.
+type Message struct {
+	tags     map[string]string
+	source   string
+	command  string
+	params   []string
+	trailing bool
+}
+
+func init() {
+	CapRegister(&Capability{name: "message-tags"})
+	CapRegister(&Capability{name: "server-time"})
+	CapRegister(&Capability{name: "echo-message"})
+}
+
+// Generate unique message identifier.
+func NewMsgID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Stamp message with server-time and newly generated msgid tags.
+// Returns that msgid.
+func (m *Message) Stamp(when time.Time) string {
+	if m.tags == nil {
+		m.tags = make(map[string]string)
+	}
+	msgid := NewMsgID()
+	m.tags["time"] = when.UTC().Format(TimeFormat)
+	m.tags["msgid"] = msgid
+	return msgid
+}
+
+func NewMessage(source, command string, params ...string) *Message {
+	return &Message{source: source, command: command, params: params}
+}
+
+// Get client-only tags (prefixed with "+"), that are relayed as is.
+func (m *Message) ClientTags() map[string]string {
+	var tags map[string]string
+	for k, v := range m.tags {
+		if strings.HasPrefix(k, "+") {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// Get n-th parameter or empty string if there is no such one.
+func (m *Message) Param(n int) string {
+	if n < len(m.params) {
+		return m.params[n]
+	}
+	return ""
+}
+
+func tagUnescape(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	unescaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		if c, found := tagUnescapes[value[i]]; found {
+			unescaped = append(unescaped, c)
+		} else {
+			unescaped = append(unescaped, value[i])
+		}
+	}
+	return string(unescaped)
+}
+
+// Parse a line according to RFC 1459 message format with IRCv3
+// message-tags extension:
+// [@tags SPACE] [:source SPACE] command [params] [SPACE :trailing]
+// Command is uppercased.
+func ParseMessage(line string) (*Message, error) {
+	m := Message{}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			return nil, ErrEmptyMessage
+		}
+		tags := line[1:i]
+		line = strings.TrimLeft(line[i+1:], " ")
+		m.tags = make(map[string]string)
+		for _, tag := range strings.Split(tags, ";") {
+			if tag == "" {
+				continue
+			}
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) == 1 {
+				m.tags[kv[0]] = ""
+			} else {
+				m.tags[kv[0]] = tagUnescape(kv[1])
+			}
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			return nil, ErrEmptyMessage
+		}
+		m.source, line = line[1:i], strings.TrimLeft(line[i+1:], " ")
+	}
+	if i := strings.IndexByte(line, ' '); i == -1 {
+		m.command, line = line, ""
+	} else {
+		m.command, line = line[:i], line[i+1:]
+	}
+	if m.command == "" {
+		return nil, ErrEmptyMessage
+	}
+	m.command = strings.ToUpper(m.command)
+	m.params = make([]string, 0)
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, ":") || len(m.params) == MaxParams-1 {
+			m.params = append(m.params, strings.TrimPrefix(line, ":"))
+			m.trailing = true
+			break
+		}
+		if i := strings.IndexByte(line, ' '); i == -1 {
+			m.params, line = append(m.params, line), ""
+		} else {
+			m.params, line = append(m.params, line[:i]), line[i+1:]
+		}
+	}
+	return &m, nil
+}
+
+// Serialize message. Tags are sorted by their names.
+func (m *Message) String() string {
+	parts := make([]string, 0, 3+len(m.params))
+	if len(m.tags) > 0 {
+		tags := make([]string, 0, len(m.tags))
+		for k, v := range m.tags {
+			if v == "" {
+				tags = append(tags, k)
+			} else {
+				tags = append(tags, k+"="+tagEscapes.Replace(v))
+			}
+		}
+		sort.Strings(tags)
+		parts = append(parts, "@"+strings.Join(tags, ";"))
+	}
+	if m.source != "" {
+		parts = append(parts, ":"+m.source)
+	}
+	parts = append(parts, m.command)
+	for n, param := range m.params {
+		if n == len(m.params)-1 && (m.trailing ||
+			param == "" ||
+			strings.HasPrefix(param, ":") ||
+			strings.Contains(param, " ")) {
+			param = ":" + param
+		}
+		parts = append(parts, param)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,204 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	for line, want := range map[string]Message{
+		"privmsg #a hi": {
+			command: "PRIVMSG",
+			params:  []string{"#a", "hi"},
+		},
+		"PRIVMSG  #a   :hi there ": {
+			command:  "PRIVMSG",
+			params:   []string{"#a", "hi there "},
+			trailing: true,
+		},
+		"PRIVMSG #a ::) smile": {
+			command:  "PRIVMSG",
+			params:   []string{"#a", ":) smile"},
+			trailing: true,
+		},
+		":nick!user@host TOPIC #a :": {
+			source:   "nick!user@host",
+			command:  "TOPIC",
+			params:   []string{"#a", ""},
+			trailing: true,
+		},
+		"@+typing=active;msgid=a\\sb\\:c\\\\;flag :src TAGMSG #a": {
+			tags:    map[string]string{"+typing": "active", "msgid": "a b;c\\", "flag": ""},
+			source:  "src",
+			command: "TAGMSG",
+			params:  []string{"#a"},
+		},
+		"CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16": {
+			command:  "CMD",
+			params:   []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15 16"},
+			trailing: true,
+		},
+	} {
+		got, err := ParseMessage(line)
+		if err != nil {
+			t.Fatal("parse", line, err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Fatalf("parse %q: got %#v, want %#v", line, *got, want)
+		}
+	}
+	for _, line := range []string{"", "   ", "@tag", "@tag :src", ":src"} {
+		if _, err := ParseMessage(line); err == nil {
+			t.Fatal("empty message parsed", line)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	for _, line := range []string{
+		"PRIVMSG #a :hi there",
+		":nick!user@host MODE #a +o nick2",
+		"@+draft/react=:);msgid=a\\sb\\:c :src PRIVMSG #a ::)",
+		"TOPIC #a :",
+	} {
+		m, err := ParseMessage(line)
+		if err != nil {
+			t.Fatal("parse", line, err)
+		}
+		if got := m.String(); got != line {
+			t.Fatalf("serialize: got %q, want %q", got, line)
+		}
+	}
+	m := NewMessage("src", "JOIN", "#a")
+	if got := m.String(); got != ":src JOIN #a" {
+		t.Fatal("serialize without trailing", got)
+	}
+	m.trailing = true
+	if got := m.String(); got != ":src JOIN :#a" {
+		t.Fatal("serialize with trailing", got)
+	}
+}
+
+func TestMessageTags(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+
+	conn1.inbound <- "CAP LS 302"
+	<-conn1.outbound
+	conn1.inbound <- "CAP REQ :message-tags echo-message"
+	if r := <-conn1.outbound; r != ":foohost CAP * ACK :message-tags echo-message\r\n" {
+		t.Fatal("CAP ACK", r)
+	}
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "CAP REQ server-time"
+	if r := <-conn2.outbound; r != ":foohost CAP * ACK :server-time\r\n" {
+		t.Fatal("CAP ACK", r)
+	}
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2\r\nCAP END"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn2.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+
+	parse := func(r string) *Message {
+		msg, err := ParseMessage(strings.TrimSuffix(r, "\r\n"))
+		if err != nil {
+			t.Fatal("unparsable", r)
+		}
+		return msg
+	}
+	conn2.inbound <- "@+draft/reply=1;server=x PRIVMSG #foo :hi"
+	r := <-conn1.outbound
+	msg := parse(r)
+	if msg.source != "nick2!foo2@someclient" || msg.command != "PRIVMSG" ||
+		len(msg.tags) != 3 || msg.tags["+draft/reply"] != "1" ||
+		len(msg.tags["msgid"]) == 0 || len(msg.tags["time"]) != len(TimeFormat) {
+		t.Fatal("tagged room message", r)
+	}
+	msgid := msg.tags["msgid"]
+	conn2.inbound <- "@+draft/react=x TAGMSG nick1"
+	r = <-conn1.outbound
+	msg = parse(r)
+	if msg.command != "TAGMSG" || msg.tags["+draft/react"] != "x" || msg.tags["msgid"] == msgid {
+		t.Fatal("direct TAGMSG", r)
+	}
+	conn1.inbound <- "@+draft/react=x TAGMSG #foo"
+	if r = <-conn1.outbound; parse(r).command != "TAGMSG" {
+		t.Fatal("TAGMSG echo", r)
+	}
+	conn1.inbound <- "@+draft/reply=1 PRIVMSG #foo :hello"
+	r = <-conn2.outbound
+	msg = parse(r)
+	if len(msg.tags) != 1 || msg.tags["time"] == "" || msg.String() != "@time="+msg.tags["time"]+
+		" :nick1!foo1@someclient PRIVMSG #foo :hello" {
+		t.Fatal("tags are not stripped", r)
+	}
+	r = <-conn1.outbound
+	echo := parse(r)
+	if echo.tags["time"] != msg.tags["time"] || echo.tags["+draft/reply"] != "1" ||
+		echo.tags["msgid"] == "" || echo.params[1] != "hello" {
+		t.Fatal("room message echo", r)
+	}
+	conn1.inbound <- "NOTICE nick2 :direct"
+	if r = <-conn2.outbound; !strings.HasSuffix(r, " :nick1!foo1@someclient NOTICE nick2 :direct\r\n") {
+		t.Fatal("direct message", r)
+	}
+	if r = <-conn1.outbound; !strings.HasSuffix(r, " :nick1!foo1@someclient NOTICE nick2 :direct\r\n") {
+		t.Fatal("direct message echo", r)
+	}
+
+	conn1.inbound <- "@" + strings.Repeat("a", MaxTagsLen) + " PING :foo"
+	if r := <-conn1.outbound; r != ":foohost 417 nick1 :Input line was too long\r\n" {
+		t.Fatal("too long tags", r)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Maximal length of targets list in single MONITOR reply
+	MonitorLineLen = 400
+)
+
+var (
+	// Monitored nicknames and clients watching them
+	monitors  map[string]map[*Client]struct{} = make(map[string]map[*Client]struct{})
+	monitorsM sync.RWMutex
+)
+
+// Send monitor numeric with the targets list split on several lines.
+func ReplyMonitor(client *Client, code string, targets []string) {
+	var line []string
+	var lineLen int
+	for _, target := range targets {
+		if len(line) > 0 && lineLen+len(target) > MonitorLineLen {
+			client.ReplyNicknamed(code, strings.Join(line, ","))
+			line, lineLen = nil, 0
+		}
+		line = append(line, target)
+		lineLen += len(target) + 1
+	}
+	if len(line) > 0 {
+		client.ReplyNicknamed(code, strings.Join(line, ","))
+	}
+}
+
+// Send 730 and 731 replies with the status of the nicknames.
+func MonitorStatus(client *Client, nicknames []string) {
+	online := make([]string, 0)
+	offline := make([]string, 0)
+	for _, nickname := range nicknames {
+		if c := ClientFind(nickname); c != nil {
+			online = append(online, c.String())
+		} else {
+			offline = append(offline, nickname)
+		}
+	}
+	ReplyMonitor(client, "730", online)
+	ReplyMonitor(client, "731", offline)
+}
+
+// Nicknames monitored by the client, sorted.
+func MonitorList(client *Client) []string {
+	nicknames := make([]string, 0)
+	monitorsM.RLock()
+	for nickname, watchers := range monitors {
+		if _, found := watchers[client]; found {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	monitorsM.RUnlock()
+	sort.Strings(nicknames)
+	return nicknames
+}
+
+// Stop monitoring the nickname, or all of them if it is empty.
+func MonitorRemove(client *Client, nickname string) {
+	monitorsM.Lock()
+	for n, watchers := range monitors {
+		if nickname != "" && n != nickname {
+			continue
+		}
+		delete(watchers, client)
+		if len(watchers) == 0 {
+			delete(monitors, n)
+		}
+	}
+	monitorsM.Unlock()
+}
+
+// Notify clients monitoring the nickname that it became online as
+// specified nick!user@host, or offline if it is empty.
+func MonitorNotify(nickname, who string) {
+	monitorsM.RLock()
+	watchers := make([]*Client, 0, len(monitors[nickname]))
+	for watcher := range monitors[nickname] {
+		watchers = append(watchers, watcher)
+	}
+	monitorsM.RUnlock()
+	for _, watcher := range watchers {
+		if who == "" {
+			watcher.Notify(fmt.Sprintf(":%s 731 %s :%s", *hostname, *watcher.nickname, nickname))
+		} else {
+			watcher.Notify(fmt.Sprintf(":%s 730 %s :%s", *hostname, *watcher.nickname, who))
+		}
+	}
+}
+
+// MONITOR command processor: add (+), remove (-), clear (C) monitored
+// nicknames, list (L) them or show their status (S).
+func HandlerMonitor(client *Client, params []string) {
+	if len(params) == 0 {
+		client.ReplyNotEnoughParameters("MONITOR")
+		return
+	}
+	switch params[0] {
+	case "+":
+		if len(params) < 2 {
+			client.ReplyNotEnoughParameters("MONITOR")
+			return
+		}
+		added := make([]string, 0)
+		count := len(MonitorList(client))
+		for _, nickname := range strings.Split(params[1], ",") {
+			nickname = strings.ToLower(nickname)
+			if !RENickname.MatchString(nickname) {
+				continue
+			}
+			monitorsM.Lock()
+			watchers, found := monitors[nickname]
+			if !found {
+				watchers = make(map[*Client]struct{})
+				monitors[nickname] = watchers
+			}
+			if _, found = watchers[client]; found {
+				monitorsM.Unlock()
+				continue
+			}
+			if count >= *monLimit {
+				if len(watchers) == 0 {
+					delete(monitors, nickname)
+				}
+				monitorsM.Unlock()
+				client.ReplyNicknamed(
+					"734",
+					strconv.Itoa(*monLimit),
+					params[1],
+					"Monitor list is full",
+				)
+				break
+			}
+			watchers[client] = struct{}{}
+			monitorsM.Unlock()
+			count++
+			added = append(added, nickname)
+		}
+		MonitorStatus(client, added)
+	case "-":
+		if len(params) < 2 {
+			client.ReplyNotEnoughParameters("MONITOR")
+			return
+		}
+		for _, nickname := range strings.Split(params[1], ",") {
+			if nickname != "" {
+				MonitorRemove(client, strings.ToLower(nickname))
+			}
+		}
+	case "C", "c":
+		MonitorRemove(client, "")
+	case "L", "l":
+		ReplyMonitor(client, "732", MonitorList(client))
+		client.ReplyNicknamed("733", "End of MONITOR list")
+	case "S", "s":
+		MonitorStatus(client, MonitorList(client))
+	}
+}
@@ -0,0 +1,129 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	monitors = make(map[string]map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	client1 := NewClient(conn1)
+	go client1.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "MONITOR + nick2,Nick3"
+	if r := <-conn1.outbound; r != ":foohost 731 nick1 :nick2,nick3\r\n" {
+		t.Fatal("offline targets", r)
+	}
+
+	conn2 := NewTestingConn()
+	client2 := NewClient(conn2)
+	go client2.Processor(events)
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	if r := <-conn1.outbound; r != ":foohost 730 nick1 :nick2!foo2@someclient\r\n" {
+		t.Fatal("registration notify", r)
+	}
+	for i := 0; i < 8; i++ {
+		<-conn2.outbound
+	}
+	conn1.inbound <- "MONITOR L"
+	if r := <-conn1.outbound; r != ":foohost 732 nick1 :nick2,nick3\r\n" {
+		t.Fatal("list", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 733 nick1 :End of MONITOR list\r\n" {
+		t.Fatal("list end", r)
+	}
+	conn2.inbound <- "NICK nick3"
+	<-conn2.outbound
+	if r := <-conn1.outbound; r != ":foohost 731 nick1 :nick2\r\n" {
+		t.Fatal("old nickname notify", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 730 nick1 :nick3!foo2@someclient\r\n" {
+		t.Fatal("new nickname notify", r)
+	}
+	conn1.inbound <- "MONITOR S"
+	if r := <-conn1.outbound; r != ":foohost 730 nick1 :nick3!foo2@someclient\r\n" {
+		t.Fatal("online status", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 731 nick1 :nick2\r\n" {
+		t.Fatal("offline status", r)
+	}
+	conn2.inbound <- "QUIT"
+	conn2.inbound <- ""
+	if r := <-conn1.outbound; r != ":foohost 731 nick1 :nick3\r\n" {
+		t.Fatal("quit notify", r)
+	}
+
+	conn1.inbound <- "MONITOR - nick3"
+	conn1.inbound <- "MONITOR L"
+	if r := <-conn1.outbound; r != ":foohost 732 nick1 :nick2\r\n" {
+		t.Fatal("list after removal", r)
+	}
+	<-conn1.outbound
+	conn1.inbound <- "MONITOR C"
+	limit := *monLimit
+	*monLimit = 1
+	defer func() { *monLimit = limit }()
+	conn1.inbound <- "MONITOR + nick4,nick5"
+	if r := <-conn1.outbound; r != ":foohost 734 nick1 1 nick4,nick5 :Monitor list is full\r\n" {
+		t.Fatal("list limit", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 731 nick1 :nick4\r\n" {
+		t.Fatal("targets within limit", r)
+	}
+	conn1.inbound <- "QUIT"
+	conn1.inbound <- ""
+	for range conn1.outbound {
+	}
+	for i := 0; ; i++ {
+		monitorsM.RLock()
+		left := len(monitors)
+		monitorsM.RUnlock()
+		if left == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("subscriptions are not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Scheme prefix of hashed passwords in passwords file
+	PasswordScheme     = "pbkdf2-sha256"
+	PasswordIterations = 100000
+	PasswordSaltLen    = 16
+	PasswordHashLen    = 32
+)
+
+var (
+	PasswordEncoding = base64.RawStdEncoding
+)
+
+// Hash password with random salt. Result has the following form:
+// pbkdf2-sha256$iterations$salt$hash, with base64-encoded salt and hash.
+func PasswordHash(password string) (string, error) {
+	salt := make([]byte, PasswordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, PasswordIterations, PasswordHashLen)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		PasswordScheme,
+		strconv.Itoa(PasswordIterations),
+		PasswordEncoding.EncodeToString(salt),
+		PasswordEncoding.EncodeToString(hash),
+	}, "$"), nil
+}
+
+// Check password against the one stored in passwords file. Stored one
+// is either hashed or, if it has no known scheme prefix, plaintext.
+// Empty stored password never matches.
+func PasswordCheck(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if !strings.HasPrefix(stored, PasswordScheme+"$") {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	fields := strings.Split(stored, "$")
+	if len(fields) != 4 {
+		return false
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := PasswordEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+	hashStored, err := PasswordEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(hashStored))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, hashStored) == 1
+}
+
+// "passwd" subcommand: read password from stdin and print passwords
+// file entry for the login with hashed password.
+func Passwd(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: goircd passwd login < password")
+		os.Exit(1)
+	}
+	if strings.Contains(args[0], ":") {
+		log.Fatalln("Login can not contain colon")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalln("Can not read password", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatalln("Empty password")
+	}
+	hash, err := PasswordHash(password)
+	if err != nil {
+		log.Fatalln("Can not hash password", err)
+	}
+	fmt.Println(args[0] + ":" + hash)
+}
@@ -0,0 +1,52 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordCheck(t *testing.T) {
+	hash, err := PasswordHash("secret")
+	if err != nil {
+		t.Fatal("password hashing", err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$100000$") || strings.Contains(hash, ":") {
+		t.Fatal("hashed password format", hash)
+	}
+	if !PasswordCheck(hash, "secret") {
+		t.Fatal("hashed password check")
+	}
+	if PasswordCheck(hash, "wrong") {
+		t.Fatal("wrong hashed password check")
+	}
+	if hash2, _ := PasswordHash("secret"); hash2 == hash {
+		t.Fatal("hash is not salted")
+	}
+	if !PasswordCheck("secret", "secret") || PasswordCheck("secret", "wrong") {
+		t.Fatal("plaintext password check")
+	}
+	if PasswordCheck("", "") {
+		t.Fatal("empty password check")
+	}
+	if PasswordCheck("pbkdf2-sha256$foo$bar", "foo") {
+		t.Fatal("corrupted hashed password check")
+	}
+}
@@ -23,12 +23,46 @@ import (
 	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// Maximal length of names list in single 353 reply
+	NamesLineLen = 400
 )
 
 var (
 	RERoom = regexp.MustCompile("^#[^\x00\x07\x0a\x0d ,:/]{1,200}$")
+
+	// Human readable names of the masks lists
+	MaskNames = map[rune]string{
+		'b': "ban on",
+		'e': "ban exception on",
+		'I': "invite exception on",
+	}
+	// Numeric replies used for listing masks lists: entry and its end
+	MaskReplies = map[rune][3]string{
+		'b': {"367", "368", "End of channel ban list"},
+		'e': {"348", "349", "End of channel exception list"},
+		'I': {"346", "347", "End of channel invite list"},
+	}
+
+	// Room's flag modes in the order they are shown
+	RoomFlags = "imnpst"
+	// Flag modes of the newly created room
+	RoomFlagsDefault = "nt"
+	// Human readable names of the flag modes
+	RoomFlagNames = map[rune]string{
+		'i': "invite-only mode",
+		'm': "moderated mode",
+		'n': "no external messages mode",
+		'p': "private mode",
+		's': "secret mode",
+		't': "topic protection mode",
+	}
 )
 
 // Sanitize room's name. It can consist of 1 to 50 ASCII symbols
@@ -37,11 +71,147 @@ func RoomNameValid(name string) bool {
 	return RERoom.MatchString(name)
 }
 
+// Fold room's name according to the ascii casemapping: rooms differing
+// only in case of ASCII letters are the same one.
+func RoomKey(name string) string {
+	key := []byte(name)
+	for i, c := range key {
+		if 'A' <= c && c <= 'Z' {
+			key[i] = c + 'a' - 'A'
+		}
+	}
+	return string(key)
+}
+
+// Member's status inside the room
+type Member struct {
+	op    bool
+	voice bool
+}
+
+// Prefix shown before member's nickname in NAMES list
+func (m *Member) Prefix() string {
+	if m.op {
+		return "@"
+	}
+	if m.voice {
+		return "+"
+	}
+	return ""
+}
+
+// Prefixes of all member's statuses if multi is set, otherwise the
+// highest one only.
+func (m *Member) Prefixes(multi bool) string {
+	if !multi || !m.op || !m.voice {
+		return m.Prefix()
+	}
+	return "@+"
+}
+
+// Entry of the room's masks lists (bans, exceptions)
+type Mask struct {
+	mask string
+	who  string
+	when time.Time
+}
+
+// Match nick!user@host against the mask with "*" and "?" wildcards.
+// Comparison is case insensitive.
+func MaskMatch(mask, s string) bool {
+	mask = strings.ToLower(mask)
+	s = strings.ToLower(s)
+	var mi, si int
+	star := -1
+	var mark int
+	for si < len(s) {
+		if mi < len(mask) && (mask[mi] == '?' || mask[mi] == s[si]) {
+			mi++
+			si++
+		} else if mi < len(mask) && mask[mi] == '*' {
+			star = mi
+			mark = si
+			mi++
+		} else if star != -1 {
+			mi = star + 1
+			mark++
+			si = mark
+		} else {
+			return false
+		}
+	}
+	for mi < len(mask) && mask[mi] == '*' {
+		mi++
+	}
+	return mi == len(mask)
+}
+
+// Complete partial mask to the nick!user@host form.
+func MaskNormalize(mask string) string {
+	bang := strings.Contains(mask, "!")
+	at := strings.Contains(mask, "@")
+	switch {
+	case !bang && !at:
+		return mask + "!*@*"
+	case !bang:
+		return "*!" + mask
+	case !at:
+		return mask + "@*"
+	}
+	return mask
+}
+
+// Add the mask to the list. Returns false if it already exists.
+func MasksAdd(masks []*Mask, mask, who string) ([]*Mask, bool) {
+	for _, m := range masks {
+		if strings.ToLower(m.mask) == strings.ToLower(mask) {
+			return masks, false
+		}
+	}
+	return append(masks, &Mask{mask, who, time.Now()}), true
+}
+
+// Remove the mask from the list. Returns false if it is absent.
+func MasksRemove(masks []*Mask, mask string) ([]*Mask, bool) {
+	for i, m := range masks {
+		if strings.ToLower(m.mask) == strings.ToLower(mask) {
+			return append(masks[:i:i], masks[i+1:]...), true
+		}
+	}
+	return masks, false
+}
+
+// Does any of masks match the client
+func MasksMatch(masks []*Mask, client *Client) bool {
+	if len(masks) == 0 {
+		return false
+	}
+	who := client.String()
+	for _, m := range masks {
+		if MaskMatch(m.mask, who) {
+			return true
+		}
+	}
+	return false
+}
+
 type Room struct {
 	name    *string
 	topic   *string
 	key     *string
-	members map[*Client]struct{}
+	members map[*Client]*Member
+	flags   map[rune]bool
+	limit   int
+	// Number of recent messages and maximal their age replayed on join
+	history int
+	window  time.Duration
+	// Room's creation and last topic change time
+	created  time.Time
+	topicSet time.Time
+	bans     []*Mask
+	excepts  []*Mask
+	invex    []*Mask
+	invited  map[*Client]struct{}
 	sync.RWMutex
 }
 
@@ -55,12 +225,19 @@ func (room *Room) String() (name string) {
 func NewRoom(name string) *Room {
 	topic := ""
 	key := ""
-	return &Room{
+	room := Room{
 		name:    &name,
 		topic:   &topic,
 		key:     &key,
-		members: make(map[*Client]struct{}),
+		members: make(map[*Client]*Member),
+		flags:   make(map[rune]bool),
+		invited: make(map[*Client]struct{}),
+		created: time.Now(),
 	}
+	for _, flag := range RoomFlagsDefault {
+		room.flags[flag] = true
+	}
+	return &room
 }
 
 func (room *Room) SendTopic(client *Client) {
@@ -73,24 +250,358 @@ func (room *Room) SendTopic(client *Client) {
 	room.RUnlock()
 }
 
-// Send message to all room's subscribers, possibly excluding someone.
-func (room *Room) Broadcast(msg string, clientToIgnore ...*Client) {
+// Send message caused by the client to all room's subscribers. The
+// client himself receives it as the command's response if withSelf.
+func (room *Room) Broadcast(from *Client, msg string, withSelf bool) {
 	room.RLock()
 	for member := range room.members {
-		if (len(clientToIgnore) > 0) && member == clientToIgnore[0] {
-			continue
+		if member != from {
+			member.Notify(msg)
+		} else if withSelf {
+			member.Msg(msg)
+		}
+	}
+	room.RUnlock()
+}
+
+// Find room's member by his nickname.
+func (room *Room) MemberFind(nickname string) (*Client, *Member) {
+	nickname = strings.ToLower(nickname)
+	for client, member := range room.members {
+		if *client.nickname == nickname {
+			return client, member
+		}
+	}
+	return nil, nil
+}
+
+// Get the masks list corresponding to the mode letter.
+func (room *Room) masks(mode rune) *[]*Mask {
+	switch mode {
+	case 'e':
+		return &room.excepts
+	case 'I':
+		return &room.invex
+	}
+	return &room.bans
+}
+
+// Room's modes with their arguments, like "+ntkl secret 10". Key is
+// omitted if withKey is false.
+func (room *Room) Modes(withKey bool) string {
+	modes := "+"
+	for _, flag := range RoomFlags {
+		if room.flags[flag] {
+			modes += string(flag)
+		}
+	}
+	args := make([]string, 0, 2)
+	if withKey && *room.key != "" {
+		modes += "k"
+		args = append(args, *room.key)
+	}
+	if room.limit > 0 {
+		modes += "l"
+		args = append(args, strconv.Itoa(room.limit))
+	}
+	if room.history > 0 || room.window > 0 {
+		modes += "H"
+		args = append(args, ReplayString(room.history, room.window))
+	}
+	return strings.Join(append([]string{modes}, args...), " ")
+}
+
+// Parse history replay mode argument: "count" or "count:window", where
+// window is either number of seconds or duration like "1h30m". Zero
+// count with the window means all messages inside it. Count is capped
+// at HistoryLimit.
+func ReplayParse(arg string) (int, time.Duration, bool) {
+	cols := strings.SplitN(arg, ":", 2)
+	count, err := strconv.Atoi(cols[0])
+	if err != nil || count < 0 || (count == 0 && len(cols) == 1) {
+		return 0, 0, false
+	}
+	if count > HistoryLimit {
+		count = HistoryLimit
+	}
+	if len(cols) == 1 {
+		return count, 0, true
+	}
+	var window time.Duration
+	if seconds, err := strconv.Atoi(cols[1]); err == nil {
+		window = time.Duration(seconds) * time.Second
+	} else if window, err = time.ParseDuration(cols[1]); err != nil {
+		return 0, 0, false
+	}
+	if window < 0 || (count == 0 && window < time.Second) {
+		return 0, 0, false
+	}
+	return count, window, true
+}
+
+// History replay mode argument in canonical form.
+func ReplayString(count int, window time.Duration) string {
+	if window < time.Second {
+		return strconv.Itoa(count)
+	}
+	return fmt.Sprintf("%d:%d", count, int(window/time.Second))
+}
+
+// Replay recent room's messages to the joined client. Clients with
+// server-time capability receive them as original messages inside the
+// batch, others as notices with the time in the text.
+func (room *Room) Replay(client *Client) {
+	room.RLock()
+	count, window := room.history, room.window
+	room.RUnlock()
+	if count == 0 && window == 0 {
+		return
+	}
+	if count == 0 {
+		count = HistoryLimit
+	}
+	entries, _ := HistorySelect(room.String(), "LATEST", []string{"*"}, count)
+	if window > 0 {
+		since := time.Now().Add(-window)
+		for len(entries) > 0 && entries[0].when.Before(since) {
+			entries = entries[1:]
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if client.CapEnabled("server-time") {
+		HistorySend(client, room.String(), entries)
+		return
+	}
+	for _, entry := range entries {
+		format := "[%s] <%s> %s"
+		if entry.command == "NOTICE" {
+			format = "[%s] -%s- %s"
+		}
+		client.Msg(NewMessage(*hostname, "NOTICE", room.String(), fmt.Sprintf(
+			format,
+			entry.when.UTC().Format("2006-01-02 15:04:05"),
+			entry.who,
+			entry.what,
+		)).String())
+	}
+}
+
+// Sorted names of the room's members with their statuses prefixes.
+// Clients with multi-prefix capability see all the prefixes and clients
+// with userhost-in-names see full nick!user@host.
+func (room *Room) Names(client *Client) []string {
+	multi := client.CapEnabled("multi-prefix")
+	userhost := client.CapEnabled("userhost-in-names")
+	names := make([]string, 0)
+	room.RLock()
+	for m, member := range room.members {
+		name := *m.nickname
+		if userhost {
+			name = m.String()
+		}
+		names = append(names, member.Prefixes(multi)+name)
+	}
+	room.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Send 353 replies with room's members names, split on several lines
+// if needed. End of the list is not sent.
+func (room *Room) SendNames(client *Client) {
+	kind := "="
+	room.RLock()
+	if room.flags['s'] {
+		kind = "@"
+	} else if room.flags['p'] {
+		kind = "*"
+	}
+	room.RUnlock()
+	ReplyNames(client, kind, room.String(), room.Names(client))
+}
+
+// Send 353 replies with names, splitting them on several lines.
+func ReplyNames(client *Client, kind, target string, names []string) {
+	var line []string
+	var lineLen int
+	for _, name := range names {
+		if len(line) > 0 && lineLen+len(name) > NamesLineLen {
+			client.ReplyNicknamed("353", kind, target, strings.Join(line, " "))
+			line, lineLen = nil, 0
+		}
+		line = append(line, name)
+		lineLen += len(name) + 1
+	}
+	if len(line) > 0 {
+		client.ReplyNicknamed("353", kind, target, strings.Join(line, " "))
+	}
+}
+
+// Is room hidden from LIST and WHOIS of non-members
+func (room *Room) Hidden(client *Client) bool {
+	room.RLock()
+	defer room.RUnlock()
+	if !room.flags['s'] && !room.flags['p'] {
+		return false
+	}
+	_, subscribed := room.members[client]
+	return !subscribed
+}
+
+// Has room reached its members limit
+func (room *Room) Full() bool {
+	room.RLock()
+	defer room.RUnlock()
+	return room.limit > 0 && len(room.members) >= room.limit
+}
+
+// Can client send messages to the room: external messages, moderation
+// and bans are taken into account.
+func (room *Room) CanSend(client *Client) bool {
+	room.RLock()
+	member, subscribed := room.members[client]
+	room.RUnlock()
+	if !subscribed {
+		return !room.flags['n'] && !room.flags['m'] && !room.Banned(client)
+	}
+	if member.op || member.voice {
+		return true
+	}
+	return !room.flags['m'] && !room.Banned(client)
+}
+
+// Send masks list corresponding to the mode letter to the client.
+func (room *Room) SendMasks(client *Client, mode rune) {
+	replies := MaskReplies[mode]
+	room.RLock()
+	for _, m := range *room.masks(mode) {
+		client.ReplyNicknamed(
+			replies[0],
+			room.String(),
+			m.mask,
+			m.who,
+			fmt.Sprintf("%d", m.when.Unix()),
+		)
+	}
+	room.RUnlock()
+	client.ReplyNicknamed(replies[1], room.String(), replies[2])
+}
+
+// Is client banned in the room and has no exception
+func (room *Room) Banned(client *Client) bool {
+	room.RLock()
+	defer room.RUnlock()
+	return MasksMatch(room.bans, client) && !MasksMatch(room.excepts, client)
+}
+
+// Can not client join the room because it is invite-only one, he was
+// not invited and does not match any of invite exception masks
+func (room *Room) InviteNeeded(client *Client) bool {
+	room.RLock()
+	defer room.RUnlock()
+	if !room.flags['i'] {
+		return false
+	}
+	if _, invited := room.invited[client]; invited {
+		return false
+	}
+	return !MasksMatch(room.invex, client)
+}
+
+// Send message like Broadcast does, but with the tags subscribers are
+// able to receive.
+func (room *Room) BroadcastTagged(from *Client, msg *Message, withSelf bool) {
+	room.RLock()
+	for member := range room.members {
+		if member != from {
+			member.NotifyTagged(msg)
+		} else if withSelf {
+			member.MsgTagged(msg)
 		}
-		member.Msg(msg)
 	}
 	room.RUnlock()
 }
 
 func (room *Room) StateSave() {
 	room.RLock()
-	stateSink <- StateEvent{room.String(), *room.topic, *room.key}
+	masks := make([]string, 0, len(room.bans)+len(room.excepts)+len(room.invex))
+	for _, mode := range []rune{'b', 'e', 'I'} {
+		for _, m := range *room.masks(mode) {
+			masks = append(masks, fmt.Sprintf(
+				"%c %s %s %d", mode, m.mask, m.who, m.when.Unix(),
+			))
+		}
+	}
+	stateSink <- StateEvent{
+		room.String(),
+		*room.topic,
+		*room.key,
+		room.Modes(false),
+		room.created,
+		room.topicSet,
+		masks,
+	}
 	room.RUnlock()
 }
 
+// Restore room's state from the lines of the state file: topic, key,
+// modes, creation and topic set times and masks lists entries. Rooms
+// without saved modes keep the default ones.
+func (room *Room) StateRestore(contents []string) {
+	room.Lock()
+	defer room.Unlock()
+	room.topic = &contents[0]
+	room.key = &contents[1]
+	for _, line := range contents[2:] {
+		if strings.HasPrefix(line, "+") {
+			cols := strings.Split(line, " ")
+			room.flags = make(map[rune]bool)
+			args := cols[1:]
+			for _, flag := range cols[0][1:] {
+				if strings.ContainsRune(RoomFlags, flag) {
+					room.flags[flag] = true
+					continue
+				}
+				if len(args) == 0 {
+					break
+				}
+				switch flag {
+				case 'l':
+					room.limit, _ = strconv.Atoi(args[0])
+				case 'H':
+					room.history, room.window, _ = ReplayParse(args[0])
+				}
+				args = args[1:]
+			}
+			continue
+		}
+		cols := strings.Split(line, " ")
+		if len(cols) == 2 && (cols[0] == "C" || cols[0] == "T") {
+			when, err := strconv.ParseInt(cols[1], 10, 64)
+			if err != nil {
+				log.Printf("State corrupted for %s: %q", *room.name, line)
+			} else if cols[0] == "C" {
+				room.created = time.Unix(when, 0)
+			} else {
+				room.topicSet = time.Unix(when, 0)
+			}
+			continue
+		}
+		if len(cols) != 4 || MaskNames[rune(cols[0][0])] == "" {
+			continue
+		}
+		when, err := strconv.ParseInt(cols[3], 10, 64)
+		if err != nil {
+			log.Printf("State corrupted for %s: %q", *room.name, line)
+			continue
+		}
+		list := room.masks(rune(cols[0][0]))
+		*list = append(*list, &Mask{cols[1], cols[2], time.Unix(when, 0)})
+	}
+}
+
 func (room *Room) Processor(events <-chan ClientEvent) {
 	var client *Client
 	for event := range events {
@@ -99,26 +610,66 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 		case EventTerm:
 			roomsGroup.Done()
 			return
+		case EventSync:
+			roomsSynced <- struct{}{}
 		case EventNew:
 			room.Lock()
-			room.members[client] = struct{}{}
+			// Repeated JOIN must not reset member's status
+			if _, subscribed := room.members[client]; subscribed {
+				room.Unlock()
+				continue
+			}
+			member := &Member{}
+			// The first one joined empty room becomes its operator
+			if len(room.members) == 0 {
+				member.op = true
+			}
+			room.members[client] = member
+			delete(room.invited, client)
 			if *verbose {
 				log.Println(client, "joined", room.name)
 			}
 			room.Unlock()
 			room.SendTopic(client)
-			room.Broadcast(fmt.Sprintf(":%s JOIN %s", client, room.String()))
-			logSink <- LogEvent{room.String(), *client.nickname, "joined", true}
-			nicknames := make([]string, 0)
+			relay := NewMessage(client.String(), "JOIN", room.String())
+			when := time.Now()
+			msgid := relay.Stamp(when)
+			account := "*"
+			if client.account != nil {
+				account = *client.account
+			}
+			extended := NewMessage(client.String(), "JOIN", room.String(), account, *client.realname)
+			extended.tags = relay.tags
+			extended.trailing = true
+			var away *Message
+			if client.away != nil {
+				away = NewMessage(client.String(), "AWAY", *client.away)
+				away.trailing = true
+			}
 			room.RLock()
-			for member := range room.members {
-				nicknames = append(nicknames, *member.nickname)
+			for m := range room.members {
+				join := relay
+				if m.CapEnabled("extended-join") {
+					join = extended
+				}
+				if m == client {
+					m.MsgTagged(join)
+					continue
+				}
+				m.NotifyTagged(join)
+				if away != nil && m.CapEnabled("away-notify") {
+					m.NotifyTagged(away)
+				}
 			}
 			room.RUnlock()
-			sort.Strings(nicknames)
-			client.ReplyNicknamed("353", "=", room.String(), strings.Join(nicknames, " "))
+			logSink <- LogEvent{room.String(), *client.nickname, "joined", true, msgid, when, ""}
+			room.SendNames(client)
 			client.ReplyNicknamed("366", room.String(), "End of NAMES list")
+			room.Replay(client)
 		case EventDel:
+			room.Lock()
+			delete(room.invited, client)
+			room.Unlock()
 			room.RLock()
 			if _, subscribed := room.members[client]; !subscribed {
 				client.ReplyNicknamed("442", room.String(), "You are not on that channel")
@@ -129,11 +680,16 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 			room.Lock()
 			delete(room.members, client)
 			room.Unlock()
-			room.RLock()
-			msg := fmt.Sprintf(":%s PART %s :%s", client, room.String(), *client.nickname)
-			room.Broadcast(msg)
-			logSink <- LogEvent{room.String(), *client.nickname, "left", true}
-			room.RUnlock()
+			reason := *client.nickname
+			if event.msg != nil && event.msg.Param(1) != "" {
+				reason = event.msg.params[1]
+			}
+			relay := NewMessage(client.String(), "PART", room.String(), reason)
+			relay.trailing = true
+			when := time.Now()
+			msgid := relay.Stamp(when)
+			room.BroadcastTagged(client, relay, true)
+			logSink <- LogEvent{room.String(), *client.nickname, "left", true, msgid, when, ""}
 		case EventTopic:
 			room.RLock()
 			if _, subscribed := room.members[client]; !subscribed {
@@ -141,111 +697,346 @@ func (room *Room) Processor(events <-chan ClientEvent) {
 				room.RUnlock()
 				continue
 			}
-			if event.text == "" {
+			if len(event.msg.params) < 2 {
 				room.SendTopic(client)
 				room.RUnlock()
 				continue
 			}
+			if room.flags['t'] && !room.members[client].op {
+				client.ReplyNicknamed("482", room.String(), "You're not channel operator")
+				room.RUnlock()
+				continue
+			}
 			room.RUnlock()
-			topic := strings.TrimLeft(event.text, ":")
+			topic := event.msg.params[1]
+			if len(topic) > TopicLen {
+				topic = topic[:TopicLen]
+			}
+			when := time.Now()
 			room.Lock()
 			room.topic = &topic
+			room.topicSet = when
 			room.Unlock()
-			room.RLock()
-			msg := fmt.Sprintf(":%s TOPIC %s :%s", client, room.String(), *room.topic)
-			room.Broadcast(msg)
+			relay := NewMessage(client.String(), "TOPIC", room.String(), topic)
+			relay.trailing = true
+			msgid := relay.Stamp(when)
+			room.BroadcastTagged(client, relay, true)
 			logSink <- LogEvent{
 				room.String(),
 				*client.nickname,
-				"set topic to " + *room.topic,
+				"set topic to " + topic,
 				true,
+				msgid,
+				when,
+				"",
 			}
-			room.RUnlock()
 			room.StateSave()
 		case EventWho:
+			if room.Hidden(client) {
+				client.ReplyNicknamed("315", room.String(), "End of /WHO list")
+				continue
+			}
+			multi := client.CapEnabled("multi-prefix")
+			opts := WhoOptionsParse(event.msg.Param(1))
 			room.RLock()
-			for m := range room.members {
-				client.ReplyNicknamed(
-					"352",
-					room.String(),
-					*m.username,
-					m.Host(),
-					*hostname,
-					*m.nickname,
-					"H",
-					"0 "+*m.realname,
-				)
+			_, subscribed := room.members[client]
+			for m, member := range room.members {
+				if (opts.ops && !member.op) || (m.invisible && !subscribed) {
+					continue
+				}
+				ReplyWho(client, room.String(), m, member.Prefixes(multi), opts)
 			}
 			client.ReplyNicknamed("315", room.String(), "End of /WHO list")
 			room.RUnlock()
 		case EventMode:
 			room.RLock()
-			if event.text == "" {
-				mode := "+"
-				if *room.key != "" {
-					mode = mode + "k"
-				}
-				client.Msg(fmt.Sprintf("324 %s %s %s", *client.nickname, room.String(), mode))
+			if len(event.msg.params) < 2 {
+				_, subscribed := room.members[client]
+				client.Reply(fmt.Sprintf(
+					"324 %s %s %s",
+					*client.nickname,
+					room.String(),
+					room.Modes(subscribed),
+				))
 				room.RUnlock()
 				continue
 			}
-			if strings.HasPrefix(event.text, "b") {
-				client.ReplyNicknamed("368", room.String(), "End of channel ban list")
+			member := room.members[client]
+			room.RUnlock()
+			room.ModeChange(client, member, event.msg.params[1], event.msg.params[2:])
+		case EventInvite:
+			room.RLock()
+			member, subscribed := room.members[client]
+			if !subscribed {
+				client.ReplyNicknamed("442", room.String(), "You are not on that channel")
 				room.RUnlock()
 				continue
 			}
-			if strings.HasPrefix(event.text, "-k") || strings.HasPrefix(event.text, "+k") {
-				if _, subscribed := room.members[client]; !subscribed {
-					client.ReplyParts("442", room.String(), "You are not on that channel")
-					room.RUnlock()
-					continue
-				}
-			} else {
-				client.ReplyNicknamed("472", event.text, "Unknown MODE flag")
+			if room.flags['i'] && !member.op {
+				client.ReplyNicknamed("482", room.String(), "You're not channel operator")
 				room.RUnlock()
 				continue
 			}
+			nickname := event.msg.params[0]
+			target, _ := room.MemberFind(nickname)
 			room.RUnlock()
-			var msg string
-			var msgLog string
-			if strings.HasPrefix(event.text, "+k") {
-				cols := strings.Split(event.text, " ")
-				if len(cols) == 1 {
-					client.ReplyNotEnoughParameters("MODE")
-					continue
-				}
-				room.Lock()
-				room.key = &cols[1]
-				msg = fmt.Sprintf(":%s MODE %s +k %s", client, *room.name, *room.key)
-				msgLog = "set channel key to " + *room.key
-				room.Unlock()
-			} else {
-				key := ""
-				room.Lock()
-				room.key = &key
-				msg = fmt.Sprintf(":%s MODE %s -k", client, *room.name)
-				room.Unlock()
-				msgLog = "removed channel key"
+			if target != nil {
+				client.ReplyNicknamed("443", *target.nickname, room.String(), "is already on channel")
+				continue
 			}
-			room.Broadcast(msg)
-			logSink <- LogEvent{room.String(), *client.nickname, msgLog, true}
-			room.StateSave()
-		case EventMsg:
-			sep := strings.Index(event.text, " ")
-			room.Broadcast(fmt.Sprintf(
-				":%s %s %s :%s",
-				client,
-				event.text[:sep],
+			target = ClientFind(nickname)
+			if target == nil {
+				client.ReplyNoNickChan(nickname)
+				continue
+			}
+			room.Lock()
+			room.invited[target] = struct{}{}
+			room.Unlock()
+			client.ReplyNicknamed("341", *target.nickname, room.String())
+			target.Notify(fmt.Sprintf(":%s INVITE %s :%s", client, *target.nickname, room.String()))
+			if target.away != nil {
+				client.ReplyNicknamed("301", *target.nickname, *target.away)
+			}
+		case EventKick:
+			nickname := event.msg.params[1]
+			reason := *client.nickname
+			if event.msg.Param(2) != "" {
+				reason = event.msg.params[2]
+			}
+			room.RLock()
+			member, subscribed := room.members[client]
+			if !subscribed {
+				client.ReplyNicknamed("442", room.String(), "You are not on that channel")
+				room.RUnlock()
+				continue
+			}
+			if !member.op {
+				client.ReplyNicknamed("482", room.String(), "You're not channel operator")
+				room.RUnlock()
+				continue
+			}
+			target, _ := room.MemberFind(nickname)
+			room.RUnlock()
+			if target == nil {
+				client.ReplyNicknamed("441", nickname, room.String(), "They aren't on that channel")
+				continue
+			}
+			relay := NewMessage(client.String(), "KICK", room.String(), *target.nickname, reason)
+			relay.trailing = true
+			when := time.Now()
+			msgid := relay.Stamp(when)
+			room.BroadcastTagged(client, relay, true)
+			room.Lock()
+			delete(room.members, target)
+			room.Unlock()
+			logSink <- LogEvent{
 				room.String(),
-				event.text[sep+1:]),
-				client,
-			)
+				*client.nickname,
+				"kicked " + *target.nickname + ": " + reason,
+				true,
+				msgid,
+				when,
+				"",
+			}
+		case EventMsg:
+			if !room.CanSend(client) {
+				client.ReplyNicknamed("404", room.String(), "Cannot send to channel")
+				continue
+			}
+			if event.msg.command == "TAGMSG" {
+				relay := NewMessage(client.String(), "TAGMSG", room.String())
+				relay.tags = event.msg.ClientTags()
+				relay.Stamp(time.Now())
+				room.BroadcastTagged(client, relay, false)
+				if client.CapEnabled("echo-message") {
+					client.MsgTagged(relay)
+				}
+				continue
+			}
+			relay := NewMessage(client.String(), event.msg.command, room.String(), event.msg.params[1])
+			relay.tags = event.msg.ClientTags()
+			relay.trailing = true
+			when := time.Now()
+			msgid := relay.Stamp(when)
+			room.BroadcastTagged(client, relay, false)
+			if client.CapEnabled("echo-message") {
+				client.MsgTagged(relay)
+			}
 			logSink <- LogEvent{
 				room.String(),
 				*client.nickname,
-				event.text[sep+1:],
+				event.msg.params[1],
 				false,
+				msgid,
+				when,
+				event.msg.command,
+			}
+		}
+	}
+	// Emptied room removed by daemon
+	roomsGroup.Done()
+}
+
+// Apply MODE changes requested by the client. Each change is broadcasted
+// to the room's members separately and logged. Changes of the key and
+// masks lists are also saved in the room's state. List modes without
+// an argument are treated as a list request and are available for
+// everyone.
+func (room *Room) ModeChange(client *Client, member *Member, modes string, args []string) {
+	sign := "+"
+	var msgLog string
+	var stateChanged bool
+	for _, mode := range modes {
+		switch mode {
+		case '+', '-':
+			sign = string(mode)
+			continue
+		case 'b', 'e', 'H', 'I', 'i', 'k', 'l', 'm', 'n', 'o', 'p', 's', 't', 'v':
+		default:
+			client.ReplyNicknamed("472", sign+string(mode), "Unknown MODE flag")
+			continue
+		}
+		var arg string
+		switch {
+		case strings.ContainsRune(RoomFlags, mode):
+			// Flags have no arguments
+		case (mode == 'l' || mode == 'H') && sign == "-":
+			// Limit and replay removal have no argument
+		case len(args) > 0:
+			arg = args[0]
+			args = args[1:]
+		case MaskNames[mode] != "":
+			room.SendMasks(client, mode)
+			continue
+		case mode == 'o' || mode == 'v' || sign == "+":
+			client.ReplyNotEnoughParameters("MODE")
+			continue
+		}
+		if member == nil {
+			client.ReplyParts("442", room.String(), "You are not on that channel")
+			return
+		}
+		if !member.op {
+			client.ReplyNicknamed("482", room.String(), "You're not channel operator")
+			return
+		}
+		switch mode {
+		case 'i', 'm', 'n', 'p', 's', 't':
+			room.Lock()
+			changed := room.flags[mode] != (sign == "+")
+			room.flags[mode] = sign == "+"
+			room.Unlock()
+			if !changed {
+				continue
+			}
+			if sign == "+" {
+				msgLog = "set " + RoomFlagNames[mode]
+			} else {
+				msgLog = "removed " + RoomFlagNames[mode]
+			}
+			stateChanged = true
+		case 'b', 'e', 'I':
+			arg = MaskNormalize(arg)
+			room.Lock()
+			list := room.masks(mode)
+			changed := false
+			if sign == "+" {
+				*list, changed = MasksAdd(*list, arg, *client.nickname)
+			} else {
+				*list, changed = MasksRemove(*list, arg)
+			}
+			room.Unlock()
+			if !changed {
+				continue
+			}
+			msgLog = MaskNames[mode] + " " + arg
+			if sign == "+" {
+				msgLog = "set " + msgLog
+			} else {
+				msgLog = "removed " + msgLog
+			}
+			stateChanged = true
+		case 'k':
+			key := ""
+			if sign == "+" {
+				key = arg
+				msgLog = "set channel key to " + key
+			} else {
+				arg = ""
+				msgLog = "removed channel key"
+			}
+			room.Lock()
+			room.key = &key
+			room.Unlock()
+			stateChanged = true
+		case 'l':
+			limit := 0
+			if sign == "+" {
+				var err error
+				if limit, err = strconv.Atoi(arg); err != nil || limit < 1 {
+					continue
+				}
+				arg = strconv.Itoa(limit)
+				msgLog = "set members limit to " + arg
+			} else {
+				msgLog = "removed members limit"
+			}
+			room.Lock()
+			room.limit = limit
+			room.Unlock()
+			stateChanged = true
+		case 'H':
+			var count int
+			var window time.Duration
+			if sign == "+" {
+				var ok bool
+				if count, window, ok = ReplayParse(arg); !ok {
+					continue
+				}
+				arg = ReplayString(count, window)
+				msgLog = "set history replay to " + arg
+			} else {
+				msgLog = "removed history replay"
+			}
+			room.Lock()
+			room.history = count
+			room.window = window
+			room.Unlock()
+			stateChanged = true
+		case 'o', 'v':
+			room.Lock()
+			target, targetMember := room.MemberFind(arg)
+			if target != nil {
+				if mode == 'o' {
+					targetMember.op = sign == "+"
+				} else {
+					targetMember.voice = sign == "+"
+				}
+			}
+			room.Unlock()
+			if target == nil {
+				client.ReplyNicknamed("441", arg, room.String(), "They aren't on that channel")
+				continue
+			}
+			arg = *target.nickname
+			status := "channel operator status"
+			if mode == 'v' {
+				status = "voice"
+			}
+			if sign == "+" {
+				msgLog = "gave " + status + " to " + arg
+			} else {
+				msgLog = "took " + status + " from " + arg
 			}
 		}
+		msg := fmt.Sprintf(":%s MODE %s %s%c", client, room.String(), sign, mode)
+		if arg != "" {
+			msg += " " + arg
+		}
+		room.Broadcast(client, msg, true)
+		logSink <- LogEvent{room.String(), *client.nickname, msgLog, true, NewMsgID(), time.Now(), ""}
+	}
+	if stateChanged {
+		room.StateSave()
 	}
 }
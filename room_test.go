@@ -68,7 +68,7 @@ func TestTwoUsers(t *testing.T) {
 
 	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
 	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 8; i++ {
 		<-conn1.outbound
 		<-conn2.outbound
 	}
@@ -97,6 +97,9 @@ func TestTwoUsers(t *testing.T) {
 	}
 
 	conn1.inbound <- "LIST"
+	if r := <-conn1.outbound; r != ":foohost 321 nick1 Channel :Users  Name\r\n" {
+		t.Fatal("first LIST start", r)
+	}
 	if r := <-conn1.outbound; r != ":foohost 323 nick1 :End of /LIST\r\n" {
 		t.Fatal("first LIST", r)
 	}
@@ -138,9 +141,11 @@ func TestJoin(t *testing.T) {
 	host := "foohost"
 	hostname = &host
 	events := make(chan ClientEvent)
+	roomsM.Lock()
 	rooms = make(map[string]*Room)
-	clients = make(map[*Client]struct{})
 	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
 	finished := make(chan struct{})
 	go Processor(events, finished)
 	defer func() {
@@ -152,7 +157,7 @@ func TestJoin(t *testing.T) {
 	go client.Processor(events)
 
 	conn.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
-	for i := 0; i < 6; i++ {
+	for i := 0; i < 8; i++ {
 		<-conn.outbound
 	}
 
@@ -170,7 +175,7 @@ func TestJoin(t *testing.T) {
 	if r := <-conn.outbound; r != ":nick2!foo2@someclient JOIN #foo\r\n" {
 		t.Fatal("no JOIN message", r)
 	}
-	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :nick2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 353 nick2 = #foo :@nick2\r\n" {
 		t.Fatal("no NAMES list", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 366 nick2 #foo :End of NAMES list\r\n" {
@@ -248,8 +253,8 @@ func TestJoin(t *testing.T) {
 		t.Fatal("left #bazenc log", r)
 	}
 
-	conn.inbound <- "MODE #barenc +i"
-	if r := <-conn.outbound; r != ":foohost 472 nick2 +i :Unknown MODE flag\r\n" {
+	conn.inbound <- "MODE #barenc +z"
+	if r := <-conn.outbound; r != ":foohost 472 nick2 +z :Unknown MODE flag\r\n" {
 		t.Fatal("unknown MODE flag", r)
 	}
 
@@ -276,10 +281,580 @@ func TestJoin(t *testing.T) {
 	}
 
 	conn.inbound <- "WHO #barenc"
-	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H :0 Long name2\r\n" {
+	if r := <-conn.outbound; r != ":foohost 352 nick2 #barenc foo2 someclient foohost nick2 H@ :0 Long name2\r\n" {
 		t.Fatal("WHO", r)
 	}
 	if r := <-conn.outbound; r != ":foohost 315 nick2 #barenc :End of /WHO list\r\n" {
 		t.Fatal("end of WHO", r)
 	}
+
+	conn.inbound <- "JOIN #BarEnc newkey"
+	conn.inbound <- "TOPIC #BARENC"
+	if r := <-conn.outbound; r != ":foohost 332 nick2 #barenc :New topic\r\n" {
+		t.Fatal("room name casemapping", r)
+	}
+	roomsM.RLock()
+	_, found := rooms["#BarEnc"]
+	roomsM.RUnlock()
+	if found {
+		t.Fatal("room with other case is created")
+	}
+}
+
+func TestOperator(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	conn1.inbound <- "TOPIC #foo :Rejoined"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient TOPIC #foo :Rejoined\r\n" {
+		t.Fatal("operator status after repeated JOIN", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	<-conn1.outbound
+	<-conn2.outbound
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1 nick2\r\n" {
+		t.Fatal("NAMES with operator", r)
+	}
+	<-conn2.outbound
+
+	conn2.inbound <- "TOPIC #foo :New topic"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("TOPIC by non-operator", r)
+	}
+	conn2.inbound <- "MODE #foo +k newkey"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("MODE by non-operator", r)
+	}
+	conn2.inbound <- "MODE #foo +o nick2"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("self-op by non-operator", r)
+	}
+
+	conn1.inbound <- "MODE #foo +o nick3"
+	if r := <-conn1.outbound; r != ":foohost 441 nick1 nick3 #foo :They aren't on that channel\r\n" {
+		t.Fatal("op for non-member", r)
+	}
+	conn1.inbound <- "MODE #foo +o nick2"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +o nick2\r\n" {
+		t.Fatal("+o MODE setting", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient MODE #foo +o nick2\r\n" {
+		t.Fatal("+o MODE setting", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-logSink
+	}
+	if r := <-logSink; r.what != "gave channel operator status to nick2" {
+		t.Fatal("+o log", r)
+	}
+
+	conn2.inbound <- "TOPIC #foo :New topic"
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient TOPIC #foo :New topic\r\n" {
+		t.Fatal("TOPIC by operator", r)
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "MODE #foo -o nick1"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient MODE #foo -o nick1\r\n" {
+		t.Fatal("-o MODE setting", r)
+	}
+	<-conn2.outbound
+	conn1.inbound <- "MODE #foo -k"
+	if r := <-conn1.outbound; r != ":foohost 482 nick1 #foo :You're not channel operator\r\n" {
+		t.Fatal("MODE by deopped", r)
+	}
+
+	conn1.inbound <- "KICK #foo nick2"
+	if r := <-conn1.outbound; r != ":foohost 482 nick1 #foo :You're not channel operator\r\n" {
+		t.Fatal("KICK by non-operator", r)
+	}
+	conn2.inbound <- "KICK #foo nick3"
+	if r := <-conn2.outbound; r != ":foohost 441 nick2 nick3 #foo :They aren't on that channel\r\n" {
+		t.Fatal("KICK of non-member", r)
+	}
+	conn2.inbound <- "KICK #foo nick1 :Go away"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient KICK #foo nick1 :Go away\r\n" {
+		t.Fatal("KICK for kicked one", r)
+	}
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient KICK #foo nick1 :Go away\r\n" {
+		t.Fatal("KICK for kicker", r)
+	}
+	<-logSink
+	<-logSink
+	if r := <-logSink; (r.what != "kicked nick1: Go away") || (r.who != "nick2") || (r.meta != true) {
+		t.Fatal("KICK log", r)
+	}
+	conn1.inbound <- "TOPIC #foo"
+	if r := <-conn1.outbound; r != ":foohost 442 #foo :You are not on that channel\r\n" {
+		t.Fatal("kicked one is still member", r)
+	}
+}
+
+func TestMaskMatch(t *testing.T) {
+	for _, c := range []struct {
+		mask  string
+		s     string
+		match bool
+	}{
+		{"nick!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@*.example.com", "foo!bar@some.EXAMPLE.com", true},
+		{"n?ck*!*@*", "neck2!u@h", true},
+		{"*!*@host", "nick!user@otherhost", false},
+	} {
+		if MaskMatch(c.mask, c.s) != c.match {
+			t.Fatal("mask match", c.mask, c.s)
+		}
+	}
+	for mask, normalized := range map[string]string{
+		"nick":      "nick!*@*",
+		"user@host": "*!user@host",
+		"nick!user": "nick!user@*",
+		"n!u@h":     "n!u@h",
+	} {
+		if got := MaskNormalize(mask); got != normalized {
+			t.Fatal("mask normalize", mask, got)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-logSink
+	conn1.inbound <- "MODE #foo +b nick2"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +b nick2!*@*\r\n" {
+		t.Fatal("+b MODE setting", r)
+	}
+	if r := <-logSink; r.what != "set ban on nick2!*@*" {
+		t.Fatal("+b log", r)
+	}
+	if r := <-stateSink; len(r.masks) != 1 || !strings.HasPrefix(r.masks[0], "b nick2!*@* nick1 ") {
+		t.Fatal("+b state", r)
+	}
+	conn2.inbound <- "MODE #foo b"
+	if r := <-conn2.outbound; !strings.HasPrefix(r, ":foohost 367 nick2 #foo nick2!*@* nick1 ") {
+		t.Fatal("ban list entry", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 368 nick2 #foo :End of channel ban list\r\n" {
+		t.Fatal("ban list end", r)
+	}
+	conn2.inbound <- "MODE #foo +b nick1"
+	if r := <-conn2.outbound; r != ":foohost 442 #foo :You are not on that channel\r\n" {
+		t.Fatal("+b by non-member", r)
+	}
+
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 474 nick2 #foo :Cannot join channel (+b)\r\n" {
+		t.Fatal("banned JOIN", r)
+	}
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #foo :Cannot send to channel\r\n" {
+		t.Fatal("banned PRIVMSG", r)
+	}
+
+	conn1.inbound <- "MODE #foo +e *!foo2@*"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +e *!foo2@*\r\n" {
+		t.Fatal("+e MODE setting", r)
+	}
+	<-logSink
+	if r := <-stateSink; len(r.masks) != 2 || !strings.HasPrefix(r.masks[1], "e *!foo2@* nick1 ") {
+		t.Fatal("+e state", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("excepted JOIN", r)
+	}
+
+	room := NewRoom("#bar")
+	room.StateRestore([]string{"topic", "key", "b *!*@evil nick1 1500000000", "e good!*@* nick1 1500000000", ""})
+	if len(room.bans) != 1 || len(room.excepts) != 1 || room.bans[0].mask != "*!*@evil" {
+		t.Fatal("state restore", room.bans, room.excepts)
+	}
+}
+
+func TestInvite(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	<-logSink
+	conn1.inbound <- "MODE #foo +i"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +i\r\n" {
+		t.Fatal("+i MODE setting", r)
+	}
+	if r := <-logSink; r.what != "set invite-only mode" {
+		t.Fatal("+i log", r)
+	}
+	if r := <-stateSink; r.modes != "+int" {
+		t.Fatal("+i state", r)
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := <-conn1.outbound; r != ":foohost 324 nick1 #foo +int\r\n" {
+		t.Fatal("+i in channel modes", r)
+	}
+
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 473 nick2 #foo :Cannot join channel (+i)\r\n" {
+		t.Fatal("invite-only JOIN", r)
+	}
+	conn2.inbound <- "INVITE nick2 #foo"
+	if r := <-conn2.outbound; r != ":foohost 442 nick2 #foo :You are not on that channel\r\n" {
+		t.Fatal("INVITE by non-member", r)
+	}
+	conn1.inbound <- "INVITE nick3 #foo"
+	noNickchan(t, conn1)
+	conn1.inbound <- "INVITE nick1 #foo"
+	if r := <-conn1.outbound; r != ":foohost 443 nick1 nick1 #foo :is already on channel\r\n" {
+		t.Fatal("INVITE of member", r)
+	}
+	conn1.inbound <- "INVITE nick2 #foo"
+	if r := <-conn1.outbound; r != ":foohost 341 nick1 nick2 :#foo\r\n" {
+		t.Fatal("INVITE reply", r)
+	}
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient INVITE nick2 :#foo\r\n" {
+		t.Fatal("INVITE message", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("invited JOIN", r)
+	}
+	for i := 0; i < 3; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	conn2.inbound <- "PART #foo"
+	<-conn1.outbound
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 473 nick2 #foo :Cannot join channel (+i)\r\n" {
+		t.Fatal("invitation is not one-shot", r)
+	}
+
+	conn1.inbound <- "MODE #foo +I *!foo2@*"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +I *!foo2@*\r\n" {
+		t.Fatal("+I MODE setting", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 331 nick2 #foo :No topic is set\r\n" {
+		t.Fatal("invite exception JOIN", r)
+	}
+}
+
+func TestModes(t *testing.T) {
+	logSink = make(chan LogEvent, 16)
+	stateSink = make(chan StateEvent, 16)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := <-conn1.outbound; r != ":foohost 324 nick1 #foo +nt\r\n" {
+		t.Fatal("default modes", r)
+	}
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #foo :Cannot send to channel\r\n" {
+		t.Fatal("external message", r)
+	}
+
+	conn1.inbound <- "MODE #foo +l 1"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +l 1\r\n" {
+		t.Fatal("+l MODE setting", r)
+	}
+	conn2.inbound <- "JOIN #foo"
+	if r := <-conn2.outbound; r != ":foohost 471 nick2 #foo :Cannot join channel (+l)\r\n" {
+		t.Fatal("JOIN of full room", r)
+	}
+	conn1.inbound <- "MODE #foo -l+mk key"
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo -l\r\n" {
+		t.Fatal("-l MODE setting", r)
+	}
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +m\r\n" {
+		t.Fatal("+m MODE setting", r)
+	}
+	if r := <-conn1.outbound; r != ":nick1!foo1@someclient MODE #foo +k key\r\n" {
+		t.Fatal("+k MODE setting", r)
+	}
+	conn1.inbound <- "MODE #foo"
+	if r := <-conn1.outbound; r != ":foohost 324 nick1 #foo +mntk key\r\n" {
+		t.Fatal("modes for member", r)
+	}
+	conn2.inbound <- "MODE #foo"
+	if r := <-conn2.outbound; r != ":foohost 324 nick2 #foo +mnt\r\n" {
+		t.Fatal("modes for non-member", r)
+	}
+
+	conn2.inbound <- "JOIN #foo key"
+	for i := 0; i < 4; i++ {
+		<-conn2.outbound
+	}
+	<-conn1.outbound
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn2.outbound; r != ":foohost 404 nick2 #foo :Cannot send to channel\r\n" {
+		t.Fatal("moderated message", r)
+	}
+	conn1.inbound <- "MODE #foo +v nick2"
+	<-conn1.outbound
+	if r := <-conn2.outbound; r != ":nick1!foo1@someclient MODE #foo +v nick2\r\n" {
+		t.Fatal("+v MODE setting", r)
+	}
+	conn2.inbound <- "PRIVMSG #foo :hello"
+	if r := <-conn1.outbound; r != ":nick2!foo2@someclient PRIVMSG #foo :hello\r\n" {
+		t.Fatal("voiced message", r)
+	}
+	conn2.inbound <- "TOPIC #foo :topic"
+	if r := <-conn2.outbound; r != ":foohost 482 nick2 #foo :You're not channel operator\r\n" {
+		t.Fatal("TOPIC in topic protected room", r)
+	}
+	conn1.inbound <- "MODE #foo -t+s"
+	<-conn1.outbound
+	<-conn1.outbound
+	<-conn2.outbound
+	<-conn2.outbound
+	conn2.inbound <- "TOPIC #foo :topic"
+	if r := <-conn2.outbound; r != ":nick2!foo2@someclient TOPIC #foo :topic\r\n" {
+		t.Fatal("TOPIC in unprotected room", r)
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "PART #foo"
+	<-conn1.outbound
+	conn2.inbound <- "LIST"
+	<-conn2.outbound
+	if r := <-conn2.outbound; r != ":foohost 323 nick2 :End of /LIST\r\n" {
+		t.Fatal("secret room in LIST", r)
+	}
+	conn1.inbound <- "LIST"
+	<-conn1.outbound
+	if r := <-conn1.outbound; r != ":foohost 322 nick1 #foo 1 :topic\r\n" {
+		t.Fatal("secret room in LIST for member", r)
+	}
+	<-conn1.outbound
+
+	room := NewRoom("#bar")
+	room.StateRestore([]string{"topic", "key", "+pl 5", ""})
+	if room.Modes(true) != "+pkl key 5" {
+		t.Fatal("state restore", room.Modes(true))
+	}
+	room = NewRoom("#baz")
+	room.StateRestore([]string{"topic", "", ""})
+	if room.Modes(true) != "+nt" {
+		t.Fatal("legacy state restore", room.Modes(true))
+	}
+	room = NewRoom("#qux")
+	room.StateRestore([]string{"topic", "", "+nt", "C 1500000000", "T 1500000100", ""})
+	if room.created.Unix() != 1500000000 || room.topicSet.Unix() != 1500000100 {
+		t.Fatal("times state restore", room.created, room.topicSet)
+	}
+	for len(stateSink) > 0 {
+		<-stateSink
+	}
+	room.StateSave()
+	if r := <-stateSink; r.created.Unix() != 1500000000 || r.topicSet.Unix() != 1500000100 {
+		t.Fatal("times state save", r)
+	}
+}
+
+func TestNames(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn1 := NewTestingConn()
+	conn2 := NewTestingConn()
+	client1 := NewClient(conn1)
+	client2 := NewClient(conn2)
+	go client1.Processor(events)
+	go client2.Processor(events)
+	conn1.inbound <- "CAP LS 302"
+	<-conn1.outbound
+	conn1.inbound <- "CAP REQ :multi-prefix userhost-in-names"
+	<-conn1.outbound
+	conn1.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	conn2.inbound <- "NICK nick2\r\nUSER foo2 bar2 baz2 :Long name2"
+	for i := 0; i < 8; i++ {
+		<-conn1.outbound
+		<-conn2.outbound
+	}
+	conn1.inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conn1.outbound
+	}
+	conn1.inbound <- "MODE #foo +v nick1"
+	<-conn1.outbound
+
+	conn1.inbound <- "NAMES #foo"
+	if r := <-conn1.outbound; r != ":foohost 353 nick1 = #foo :@+nick1!foo1@someclient\r\n" {
+		t.Fatal("NAMES with multi-prefix and userhost-in-names", r)
+	}
+	if r := <-conn1.outbound; r != ":foohost 366 nick1 #foo :End of NAMES list\r\n" {
+		t.Fatal("NAMES end", r)
+	}
+	conn1.inbound <- "WHO #foo"
+	if r := <-conn1.outbound; r != ":foohost 352 nick1 #foo foo1 someclient foohost nick1 H@+ :0 Long name1\r\n" {
+		t.Fatal("WHO with multi-prefix", r)
+	}
+	<-conn1.outbound
+
+	conn2.inbound <- "NAMES #bar"
+	if r := <-conn2.outbound; r != ":foohost 366 nick2 #bar :End of NAMES list\r\n" {
+		t.Fatal("NAMES of unknown room", r)
+	}
+	conn2.inbound <- "NAMES"
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 = #foo :@nick1\r\n" {
+		t.Fatal("global NAMES", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 353 nick2 * * :nick2\r\n" {
+		t.Fatal("global NAMES without room", r)
+	}
+	if r := <-conn2.outbound; r != ":foohost 366 nick2 * :End of NAMES list\r\n" {
+		t.Fatal("global NAMES end", r)
+	}
+
+	names := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		names = append(names, "nickname")
+	}
+	ReplyNames(client2, "=", "#foo", names)
+	for i := 0; i < 3; i++ {
+		if r := <-conn2.outbound; len(r) > NamesLineLen+50 {
+			t.Fatal("too long NAMES line", r)
+		}
+	}
 }
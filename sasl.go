@@ -0,0 +1,170 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	// Maximal length of single AUTHENTICATE message payload
+	SASLChunkLen = 400
+)
+
+func init() {
+	CapRegister(&Capability{
+		name:      "sasl",
+		value:     func() string { return strings.Join(SASLMechanisms(), ",") },
+		available: func() bool { return *passwords != "" },
+	})
+}
+
+// Supported SASL mechanisms. EXTERNAL one is available only if TLS
+// client certificates are requested.
+func SASLMechanisms() []string {
+	if *tlsClient {
+		return []string{"PLAIN", "EXTERNAL"}
+	}
+	return []string{"PLAIN"}
+}
+
+// Reset client's SASL authentication exchange.
+func (c *Client) SASLReset() {
+	c.saslMechanism = ""
+	c.saslBuf = ""
+}
+
+// Bind account to the client after successful authentication.
+func (c *Client) SASLLoggedIn(account string) {
+	c.SASLReset()
+	c.account = &account
+	c.ReplyNicknamed("900", c.String(), account, "You are now logged in as "+account)
+	c.ReplyNicknamed("903", "SASL authentication successful")
+	log.Println(c, "authenticated as", account)
+	if c.registered {
+		PeersNotify(c, "account-notify", fmt.Sprintf(":%s ACCOUNT %s", c, account), false)
+	}
+}
+
+func (c *Client) SASLFailed() {
+	c.SASLReset()
+	c.ReplyNicknamed("904", "SASL authentication failed")
+}
+
+// AUTHENTICATE command processor. Client sends mechanism name first and
+// then base64-encoded payload split on 400 bytes chunks. Empty payload
+// is sent as "+" and "*" aborts the exchange.
+func HandlerAuthenticate(client *Client, msg *Message) {
+	if msg.Param(0) == "" {
+		client.ReplyNotEnoughParameters("AUTHENTICATE")
+		return
+	}
+	if !client.CapEnabled("sasl") {
+		client.SASLFailed()
+		return
+	}
+	if client.account != nil {
+		client.ReplyNicknamed("907", "You have already authenticated using SASL")
+		return
+	}
+	arg := msg.params[0]
+	if client.saslMechanism == "" {
+		mechanism := strings.ToUpper(arg)
+		for _, m := range SASLMechanisms() {
+			if m == mechanism {
+				client.saslMechanism = mechanism
+				client.Msg("AUTHENTICATE +")
+				return
+			}
+		}
+		client.ReplyNicknamed("908", strings.Join(SASLMechanisms(), ","), "are available SASL mechanisms")
+		client.SASLFailed()
+		return
+	}
+	if arg == "*" {
+		client.SASLReset()
+		client.ReplyNicknamed("906", "SASL authentication aborted")
+		return
+	}
+	if len(arg) > SASLChunkLen || len(client.saslBuf)+len(arg) > SASLChunkLen*8 {
+		client.SASLReset()
+		client.ReplyNicknamed("905", "SASL message too long")
+		return
+	}
+	if arg != "+" {
+		client.saslBuf += arg
+	}
+	if len(arg) == SASLChunkLen {
+		// More chunks follow
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(client.saslBuf)
+	if err != nil {
+		client.SASLFailed()
+		return
+	}
+	switch client.saslMechanism {
+	case "PLAIN":
+		SASLPlain(client, string(payload))
+	case "EXTERNAL":
+		SASLExternal(client, string(payload))
+	}
+}
+
+// PLAIN mechanism: authorization identity, authentication identity and
+// password separated by NUL. Authorization identity must be either empty
+// or equal to the authentication one.
+func SASLPlain(client *Client, payload string) {
+	fields := strings.Split(payload, "\x00")
+	if len(fields) != 3 || (fields[0] != "" && fields[0] != fields[1]) {
+		client.SASLFailed()
+		return
+	}
+	account := AccountLookup(fields[1])
+	if account == nil || !PasswordCheck(account.password, fields[2]) {
+		client.SASLFailed()
+		return
+	}
+	client.SASLLoggedIn(account.login)
+}
+
+// EXTERNAL mechanism: client is authenticated by his TLS certificate
+// fingerprint. Payload contains optional authorization identity,
+// otherwise the first account allowing that fingerprint is used.
+func SASLExternal(client *Client, authzid string) {
+	if client.certfp == "" {
+		client.SASLFailed()
+		return
+	}
+	for _, account := range AccountsRead() {
+		if authzid != "" && account.login != authzid {
+			continue
+		}
+		for _, fingerprint := range account.fingerprints {
+			if fingerprint == client.certfp {
+				client.SASLLoggedIn(account.login)
+				return
+			}
+		}
+	}
+	client.SASLFailed()
+}
@@ -0,0 +1,209 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSASLPlain(t *testing.T) {
+	fd, err := ioutil.TempFile("", "passwords")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("nick1:secret\nnick2:password2\n")
+	fd.Close()
+	passwordsPath := fd.Name()
+	passwords = &passwordsPath
+	defer func() {
+		passwordsPath = ""
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+
+	conn.inbound <- "CAP LS 302"
+	if r := <-conn.outbound; !strings.Contains(r, "sasl=PLAIN") {
+		t.Fatal("CAP LS with sasl", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	if r := <-conn.outbound; r != ":foohost 904 * :SASL authentication failed\r\n" {
+		t.Fatal("AUTHENTICATE without sasl capability", r)
+	}
+	conn.inbound <- "CAP REQ sasl"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE FOO"
+	if r := <-conn.outbound; r != ":foohost 908 * PLAIN :are available SASL mechanisms\r\n" {
+		t.Fatal("unknown SASL mechanism", r)
+	}
+	<-conn.outbound
+
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	if r := <-conn.outbound; r != "AUTHENTICATE +\r\n" {
+		t.Fatal("AUTHENTICATE continuation", r)
+	}
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00nick1\x00wrong"))
+	if r := <-conn.outbound; r != ":foohost 904 * :SASL authentication failed\r\n" {
+		t.Fatal("wrong password", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE *"
+	if r := <-conn.outbound; r != ":foohost 906 * :SASL authentication aborted\r\n" {
+		t.Fatal("aborted authentication", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("nick1\x00nick1\x00secret"))
+	if r := <-conn.outbound; r != ":foohost 900 * *!@someclient nick1 :You are now logged in as nick1\r\n" {
+		t.Fatal("logged in", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 903 * :SASL authentication successful\r\n" {
+		t.Fatal("authentication successful", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	if r := <-conn.outbound; r != ":foohost 907 * :You have already authenticated using SASL\r\n" {
+		t.Fatal("already authenticated", r)
+	}
+
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 001 nick1") {
+		t.Fatal("registration with SASL", r)
+	}
+	for i := 0; i < 7; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "WHOIS nick1"
+	<-conn.outbound
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 330 nick1 nick1 nick1 :is logged in as\r\n" {
+		t.Fatal("WHOIS account", r)
+	}
+	for r := <-conn.outbound; !strings.Contains(r, " 318 "); r = <-conn.outbound {
+	}
+	conn.inbound <- "NICK nick2"
+	if r := <-conn.outbound; r != ":foohost 433 nick1 nick2 :Nickname is reserved by an account\r\n" {
+		t.Fatal("NICK to other account's nickname", r)
+	}
+	conn.inbound <- "NICK nick3"
+	if r := <-conn.outbound; r != ":nick1!foo1@someclient NICK :nick3\r\n" {
+		t.Fatal("NICK to free nickname", r)
+	}
+	conn.inbound <- "NICK nick1"
+	if r := <-conn.outbound; r != ":nick3!foo1@someclient NICK :nick1\r\n" {
+		t.Fatal("NICK to own account's nickname", r)
+	}
+}
+
+func TestSASLExternal(t *testing.T) {
+	fd, err := ioutil.TempFile("", "passwords")
+	if err != nil {
+		t.Fatalf("can not create temporary file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("nick1:secret\nbot::0123,ABCDEF\n")
+	fd.Close()
+	passwordsPath := fd.Name()
+	passwords = &passwordsPath
+	tlsClientEnabled := true
+	tlsClient = &tlsClientEnabled
+	defer func() {
+		passwordsPath = ""
+		tlsClientEnabled = false
+	}()
+
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	client.certfp = "abcdef"
+	go client.Processor(events)
+
+	conn.inbound <- "CAP LS 302"
+	if r := <-conn.outbound; !strings.Contains(r, "sasl=PLAIN,EXTERNAL") {
+		t.Fatal("CAP LS with EXTERNAL", r)
+	}
+	conn.inbound <- "CAP REQ sasl"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE EXTERNAL"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("nick1"))
+	if r := <-conn.outbound; r != ":foohost 904 * :SASL authentication failed\r\n" {
+		t.Fatal("EXTERNAL for other account", r)
+	}
+	conn.inbound <- "AUTHENTICATE PLAIN"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00bot\x00"))
+	if r := <-conn.outbound; r != ":foohost 904 * :SASL authentication failed\r\n" {
+		t.Fatal("PLAIN for certificate only account", r)
+	}
+	conn.inbound <- "AUTHENTICATE EXTERNAL"
+	<-conn.outbound
+	conn.inbound <- "AUTHENTICATE +"
+	if r := <-conn.outbound; r != ":foohost 900 * *!@someclient bot :You are now logged in as bot\r\n" {
+		t.Fatal("logged in with EXTERNAL", r)
+	}
+	<-conn.outbound
+
+	conn.inbound <- "NICK bot\r\nUSER foo1 bar1 baz1 :Long name1\r\nCAP END"
+	for i := 0; i < 8; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "WHOIS bot"
+	for i := 0; i < 3; i++ {
+		<-conn.outbound
+	}
+	if r := <-conn.outbound; r != ":foohost 276 bot bot :has client certificate fingerprint abcdef\r\n" {
+		t.Fatal("WHOIS certificate fingerprint", r)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WHOX fields in the order they are sent
+const WhoxFields = "tcuihsnfdlaor"
+
+// WHO command options: "o" filter leaving only channel operators and
+// WHOX fields with the query token
+type WhoOptions struct {
+	ops    bool
+	fields string
+	token  string
+}
+
+// Parse WHO options like "o" or "%tcuihsnfar,42".
+func WhoOptionsParse(s string) WhoOptions {
+	opts := WhoOptions{}
+	i := strings.IndexByte(s, '%')
+	if i == -1 {
+		opts.ops = strings.ContainsRune(s, 'o')
+		return opts
+	}
+	opts.ops = strings.ContainsRune(s[:i], 'o')
+	fields := s[i+1:]
+	if j := strings.IndexByte(fields, ','); j != -1 {
+		fields, opts.token = fields[:j], fields[j+1:]
+	}
+	for _, field := range WhoxFields {
+		if strings.ContainsRune(fields, field) {
+			opts.fields += string(field)
+		}
+	}
+	if opts.fields == "" {
+		opts.fields = "n"
+	}
+	return opts
+}
+
+// Send single WHO reply about m: 352 or 354 WHOX one with the requested
+// fields. Channel is "*" if m is not listed as room's member.
+func ReplyWho(client *Client, channel string, m *Client, prefixes string, opts WhoOptions) {
+	flags := "H"
+	if m.away != nil {
+		flags = "G"
+	}
+	flags += prefixes
+	if opts.fields == "" {
+		client.ReplyNicknamed(
+			"352",
+			channel,
+			*m.username,
+			m.Host(),
+			*hostname,
+			*m.nickname,
+			flags,
+			"0 "+*m.realname,
+		)
+		return
+	}
+	parts := []string{"354"}
+	for _, field := range opts.fields {
+		switch field {
+		case 't':
+			token := opts.token
+			if token == "" {
+				token = "0"
+			}
+			parts = append(parts, token)
+		case 'c':
+			parts = append(parts, channel)
+		case 'u':
+			parts = append(parts, *m.username)
+		case 'i':
+			ip := "255.255.255.255"
+			if host, _, err := net.SplitHostPort(m.conn.RemoteAddr().String()); err == nil {
+				ip = host
+			}
+			parts = append(parts, ip)
+		case 'h':
+			parts = append(parts, m.Host())
+		case 's':
+			parts = append(parts, *hostname)
+		case 'n':
+			parts = append(parts, *m.nickname)
+		case 'f':
+			parts = append(parts, flags)
+		case 'd':
+			parts = append(parts, "0")
+		case 'l':
+			idle := int(time.Since(m.recvTimestamp) / time.Second)
+			parts = append(parts, strconv.Itoa(idle))
+		case 'a':
+			account := "0"
+			if m.account != nil {
+				account = *m.account
+			}
+			parts = append(parts, account)
+		case 'o':
+			parts = append(parts, "n/a")
+		case 'r':
+			parts = append(parts, *m.realname)
+		}
+	}
+	if strings.HasSuffix(opts.fields, "r") {
+		client.ReplyNicknamed(parts[0], parts[1:]...)
+	} else {
+		client.Reply(strings.Join(append([]string{parts[0], *client.nickname}, parts[1:]...), " "))
+	}
+}
+
+// Get operators of the rooms not hidden from the client.
+func RoomsOperators(client *Client) map[*Client]struct{} {
+	rs := make([]*Room, 0)
+	roomsM.RLock()
+	for _, room := range rooms {
+		rs = append(rs, room)
+	}
+	roomsM.RUnlock()
+	ops := make(map[*Client]struct{})
+	for _, room := range rs {
+		if room.Hidden(client) {
+			continue
+		}
+		room.RLock()
+		for m, member := range room.members {
+			if member.op {
+				ops[m] = struct{}{}
+			}
+		}
+		room.RUnlock()
+	}
+	return ops
+}
+
+// Send WHO replies about registered clients matching the mask by
+// nickname, nick!user@host, host, realname or server. Invisible clients
+// are shown only to ones sharing a room with them. "o" filter leaves
+// only operators of any room visible to the client.
+func SendWho(client *Client, mask string, opts WhoOptions) {
+	if mask == "0" {
+		mask = "*"
+	}
+	peers, _ := ClientPeers(client)
+	var ops map[*Client]struct{}
+	if opts.ops {
+		ops = RoomsOperators(client)
+	}
+	found := make([]*Client, 0)
+	clientsM.RLock()
+	for c := range clients {
+		if !c.registered {
+			continue
+		}
+		if _, op := ops[c]; opts.ops && !op {
+			continue
+		}
+		if _, peer := peers[c]; c.invisible && !peer {
+			continue
+		}
+		if MaskMatch(mask, *c.nickname) ||
+			MaskMatch(mask, c.String()) ||
+			MaskMatch(mask, c.Host()) ||
+			MaskMatch(mask, *c.realname) ||
+			MaskMatch(mask, *hostname) {
+			found = append(found, c)
+		}
+	}
+	clientsM.RUnlock()
+	sort.Slice(found, func(i, j int) bool { return *found[i].nickname < *found[j].nickname })
+	for _, c := range found {
+		ReplyWho(client, "*", c, "", opts)
+	}
+	client.ReplyNicknamed("315", mask, "End of /WHO list")
+}
@@ -0,0 +1,136 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestWhoOptionsParse(t *testing.T) {
+	for s, want := range map[string]WhoOptions{
+		"":                {},
+		"o":               {ops: true},
+		"%nuhr":           {fields: "uhnr"},
+		"o%tcuihsnfar,42": {ops: true, fields: "tcuihsnfar", token: "42"},
+		"%":               {fields: "n"},
+		"%zzz,1":          {fields: "n", token: "1"},
+	} {
+		if got := WhoOptionsParse(s); got != want {
+			t.Fatal(s, got)
+		}
+	}
+}
+
+func TestWho(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conns := make([]*TestingConn, 0, 3)
+	for _, n := range []string{"1", "2", "3"} {
+		conn := NewTestingConn()
+		client := NewClient(conn)
+		go client.Processor(events)
+		conn.inbound <- "NICK nick" + n + "\r\nUSER foo" + n + " bar baz :Long name" + n
+		for i := 0; i < 8; i++ {
+			<-conn.outbound
+		}
+		conns = append(conns, conn)
+	}
+	conns[0].inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conns[0].outbound
+	}
+	conns[1].inbound <- "JOIN #foo"
+	for i := 0; i < 4; i++ {
+		<-conns[1].outbound
+	}
+	<-conns[0].outbound
+	conns[1].inbound <- "AWAY :gone"
+	<-conns[1].outbound
+	conns[2].inbound <- "MODE nick3 +i"
+	<-conns[2].outbound
+
+	conns[0].inbound <- "WHO #foo o"
+	if r := <-conns[0].outbound; r != ":foohost 352 nick1 #foo foo1 someclient foohost nick1 H@ :0 Long name1\r\n" {
+		t.Fatal("WHO operators", r)
+	}
+	if r := <-conns[0].outbound; r != ":foohost 315 nick1 #foo :End of /WHO list\r\n" {
+		t.Fatal("WHO end", r)
+	}
+	conns[0].inbound <- "WHO #foo %tnfar,42"
+	replies := []string{<-conns[0].outbound, <-conns[0].outbound}
+	sort.Strings(replies)
+	if replies[0] != ":foohost 354 nick1 42 nick1 H@ 0 :Long name1\r\n" ||
+		replies[1] != ":foohost 354 nick1 42 nick2 G 0 :Long name2\r\n" {
+		t.Fatal("WHOX", replies)
+	}
+	<-conns[0].outbound
+	conns[0].inbound <- "WHO #foo %un"
+	replies = []string{<-conns[0].outbound, <-conns[0].outbound}
+	sort.Strings(replies)
+	if replies[0] != ":foohost 354 nick1 foo1 nick1\r\n" {
+		t.Fatal("WHOX without realname", replies)
+	}
+	<-conns[0].outbound
+
+	conns[0].inbound <- "WHO nick*"
+	if r := <-conns[0].outbound; r != ":foohost 352 nick1 * foo1 someclient foohost nick1 H :0 Long name1\r\n" {
+		t.Fatal("WHO mask first", r)
+	}
+	if r := <-conns[0].outbound; r != ":foohost 352 nick1 * foo2 someclient foohost nick2 G :0 Long name2\r\n" {
+		t.Fatal("WHO mask second", r)
+	}
+	if r := <-conns[0].outbound; r != ":foohost 315 nick1 nick* :End of /WHO list\r\n" {
+		t.Fatal("WHO mask skips invisible", r)
+	}
+	conns[2].inbound <- "WHO *!foo3@*"
+	if r := <-conns[2].outbound; r != ":foohost 352 nick3 * foo3 someclient foohost nick3 H :0 Long name3\r\n" {
+		t.Fatal("WHO invisible himself", r)
+	}
+	<-conns[2].outbound
+	conns[2].inbound <- "WHO * o"
+	if r := <-conns[2].outbound; r != ":foohost 352 nick3 * foo1 someclient foohost nick1 H :0 Long name1\r\n" {
+		t.Fatal("WHO channel operators", r)
+	}
+	if r := <-conns[2].outbound; r != ":foohost 315 nick3 * :End of /WHO list\r\n" {
+		t.Fatal("WHO channel operators end", r)
+	}
+	conns[0].inbound <- "MODE #foo +s"
+	<-conns[0].outbound
+	conns[2].inbound <- "WHO * o"
+	if r := <-conns[2].outbound; r != ":foohost 315 nick3 * :End of /WHO list\r\n" {
+		t.Fatal("WHO operators of secret room", r)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximal number of remembered departed nicknames
+	WhowasSize = 1000
+	// Name of the file in statedir with departed nicknames
+	WhowasFile = "whowas"
+)
+
+// Departed nickname's information
+type WhowasEntry struct {
+	nickname string
+	username string
+	host     string
+	server   string
+	when     time.Time
+	realname string
+}
+
+var (
+	whowas     []*WhowasEntry
+	whowasM    sync.Mutex
+	whowasSink chan struct{} = make(chan struct{}, 1)
+)
+
+// Remember registered client's information under his current nickname.
+// Keeper is only notified about the change, so the caller never waits
+// for the file to be written.
+func WhowasAdd(client *Client) {
+	entry := &WhowasEntry{
+		*client.nickname,
+		*client.username,
+		client.Host(),
+		*hostname,
+		time.Now(),
+		*client.realname,
+	}
+	whowasM.Lock()
+	whowas = append(whowas, entry)
+	if len(whowas) > WhowasSize {
+		whowas = append([]*WhowasEntry{}, whowas[len(whowas)-WhowasSize:]...)
+	}
+	whowasM.Unlock()
+	if *statedir != "" {
+		select {
+		case whowasSink <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Serialize remembered entries, one per line, oldest first.
+func WhowasDump() string {
+	lines := make([]string, 0, len(whowas))
+	for _, e := range whowas {
+		lines = append(lines, strings.Join([]string{
+			e.nickname,
+			e.username,
+			e.host,
+			e.server,
+			strconv.FormatInt(e.when.Unix(), 10),
+			e.realname,
+		}, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Restore remembered entries from the lines written by WhowasDump.
+func WhowasRestore(contents []string) {
+	whowasM.Lock()
+	defer whowasM.Unlock()
+	for _, line := range contents {
+		cols := strings.SplitN(line, " ", 6)
+		if len(cols) != 6 {
+			continue
+		}
+		when, err := strconv.ParseInt(cols[4], 10, 64)
+		if err != nil {
+			log.Printf("Whowas corrupted: %q", line)
+			continue
+		}
+		whowas = append(whowas, &WhowasEntry{
+			cols[0], cols[1], cols[2], cols[3], time.Unix(when, 0), cols[5],
+		})
+	}
+	if len(whowas) > WhowasSize {
+		whowas = whowas[len(whowas)-WhowasSize:]
+	}
+}
+
+// Whowas saver writes all remembered entries to the file after they
+// are changed. Changes made during the writing are coalesced into the
+// single next write.
+func WhowasKeeper(fn string, events <-chan struct{}) {
+	for range events {
+		whowasM.Lock()
+		data := WhowasDump()
+		whowasM.Unlock()
+		if err := ioutil.WriteFile(fn, []byte(data+"\n"), os.FileMode(0660)); err != nil {
+			log.Printf("Can not write whowas %s: %v", fn, err)
+		}
+	}
+}
+
+// Send WHOWAS replies for the nicknames, newest entries first. Up to
+// count entries are sent for each nickname if it is positive.
+func SendWhowas(client *Client, nicknames []string, count int) {
+	for _, nickname := range nicknames {
+		nickname = strings.ToLower(nickname)
+		found := 0
+		whowasM.Lock()
+		for i := len(whowas) - 1; i >= 0; i-- {
+			if count > 0 && found == count {
+				break
+			}
+			e := whowas[i]
+			if e.nickname != nickname {
+				continue
+			}
+			found++
+			client.ReplyNicknamed("314", e.nickname, e.username, e.host, "*", e.realname)
+			client.ReplyNicknamed("312", e.nickname, e.server, e.when.UTC().Format(time.RFC1123))
+		}
+		whowasM.Unlock()
+		if found == 0 {
+			client.ReplyNicknamed("406", nickname, "There was no such nickname")
+		}
+		client.ReplyNicknamed("369", nickname, "End of WHOWAS")
+	}
+}
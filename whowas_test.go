@@ -0,0 +1,104 @@
+/*
+goircd -- minimalistic simple Internet Relay Chat (IRC) server
+Copyright (C) 2014-2017 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhowas(t *testing.T) {
+	logSink = make(chan LogEvent, 8)
+	stateSink = make(chan StateEvent, 8)
+	host := "foohost"
+	hostname = &host
+	events := make(chan ClientEvent)
+	roomsM.Lock()
+	rooms = make(map[string]*Room)
+	roomSinks = make(map[*Room]chan ClientEvent)
+	roomsM.Unlock()
+	clients = make(map[*Client]struct{})
+	whowas = nil
+	finished := make(chan struct{})
+	go Processor(events, finished)
+	defer func() {
+		events <- ClientEvent{eventType: EventTerm}
+		<-finished
+		clients = make(map[*Client]struct{})
+	}()
+
+	conn := NewTestingConn()
+	client := NewClient(conn)
+	go client.Processor(events)
+	conn.inbound <- "NICK nick1\r\nUSER foo1 bar1 baz1 :Long name1"
+	for i := 0; i < 8; i++ {
+		<-conn.outbound
+	}
+	conn.inbound <- "WHOWAS"
+	if r := <-conn.outbound; r != ":foohost 431 nick1 :No nickname given\r\n" {
+		t.Fatal("no nickname", r)
+	}
+	conn.inbound <- "WHOWAS nick2"
+	if r := <-conn.outbound; r != ":foohost 406 nick1 nick2 :There was no such nickname\r\n" {
+		t.Fatal("unknown nickname", r)
+	}
+	if r := <-conn.outbound; r != ":foohost 369 nick1 nick2 :End of WHOWAS\r\n" {
+		t.Fatal("unknown nickname end", r)
+	}
+	for _, nickname := range []string{"nick2", "nick3", "nick2", "nick4"} {
+		conn.inbound <- "NICK " + nickname
+		<-conn.outbound
+	}
+	conn.inbound <- "WHOWAS nick2,nick1"
+	for _, nickname := range []string{"nick2", "nick2", "", "nick1", ""} {
+		if nickname == "" {
+			if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 369 nick4 ") {
+				t.Fatal("WHOWAS end", r)
+			}
+			continue
+		}
+		if r := <-conn.outbound; r != ":foohost 314 nick4 "+nickname+" foo1 someclient * :Long name1\r\n" {
+			t.Fatal("WHOWAS user", r)
+		}
+		if r := <-conn.outbound; !strings.HasPrefix(r, ":foohost 312 nick4 "+nickname+" foohost :") {
+			t.Fatal("WHOWAS server", r)
+		}
+	}
+	conn.inbound <- "WHOWAS nick2 1"
+	<-conn.outbound
+	<-conn.outbound
+	if r := <-conn.outbound; r != ":foohost 369 nick4 nick2 :End of WHOWAS\r\n" {
+		t.Fatal("WHOWAS with count", r)
+	}
+}
+
+func TestWhowasRestore(t *testing.T) {
+	whowas = nil
+	WhowasRestore([]string{
+		"nick1 foo1 someclient foohost 1500000000 Long name1",
+		"corrupted",
+		"",
+	})
+	if len(whowas) != 1 || whowas[0].realname != "Long name1" || whowas[0].when.Unix() != 1500000000 {
+		t.Fatal("restore", whowas)
+	}
+	if dump := WhowasDump(); dump != "nick1 foo1 someclient foohost 1500000000 Long name1" {
+		t.Fatal("dump", dump)
+	}
+}